@@ -0,0 +1,109 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// directDialer dials from the source address, the interface and
+// with the SO_MARK of the options.
+type directDialer struct {
+	net.Dialer
+	bindIP net.IP
+}
+
+// newDirectDialer returns the dialer of an upstream without proxy,
+// Bind of the options is either an ip or the name of an interface.
+func newDirectDialer(opts *ClientOptions) (*directDialer, error) {
+	d := &directDialer{Dialer: net.Dialer{Timeout: opts.timeout()}}
+	if opts == nil {
+		return d, nil
+	}
+
+	var iface string
+	if opts.Bind != "" {
+		if d.bindIP = net.ParseIP(opts.Bind); d.bindIP == nil {
+			iface = opts.Bind
+		}
+	}
+	if iface != "" || opts.Mark != 0 {
+		control, err := bindControl(iface, opts.Mark)
+		if err != nil {
+			return nil, err
+		}
+		d.Control = control
+	}
+	return d, nil
+}
+
+// bound reports whether the sockets need to be set up by the dialer.
+func (d *directDialer) bound() bool {
+	return d.bindIP != nil || d.Control != nil
+}
+
+func (d *directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	nd := d.Dialer
+	if d.bindIP != nil {
+		switch network {
+		case "udp", "udp4", "udp6":
+			nd.LocalAddr = &net.UDPAddr{IP: d.bindIP}
+		default:
+			nd.LocalAddr = &net.TCPAddr{IP: d.bindIP}
+		}
+	}
+	return nd.DialContext(ctx, network, addr)
+}
+
+// ListenPacket returns a UDP socket bound as the dialer.
+func (d *directDialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	addr := ":0"
+	if d.bindIP != nil {
+		addr = net.JoinHostPort(d.bindIP.String(), "0")
+	}
+	lc := &net.ListenConfig{Control: d.Control}
+	return lc.ListenPacket(ctx, "udp", addr)
+}
+
+// quicDialer dials QUIC connections, which share one bound socket
+// if the dialer binds them.
+type quicDialer struct {
+	d *directDialer
+
+	mu sync.Mutex
+	tr *quic.Transport
+}
+
+func (q *quicDialer) DialEarly(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+	if !q.d.bound() {
+		return quic.DialAddrEarly(ctx, addr, tlsConfig, config)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := q.transport(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tr.DialEarly(ctx, udpAddr, tlsConfig, config)
+}
+
+func (q *quicDialer) transport(ctx context.Context) (*quic.Transport, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.tr != nil {
+		return q.tr, nil
+	}
+	pc, err := q.d.ListenPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q.tr = &quic.Transport{Conn: pc}
+	return q.tr, nil
+}
@@ -0,0 +1,31 @@
+package dns
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindControl returns the function for net.Dialer.Control, which binds
+// the sockets to an interface and sets the SO_MARK for policy routing.
+func bindControl(iface string, mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if iface != "" {
+				if err = syscall.BindToDevice(int(fd), iface); err != nil {
+					err = fmt.Errorf("bind to interface %s failed: %w", iface, err)
+					return
+				}
+			}
+			if mark != 0 {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+					err = fmt.Errorf("set SO_MARK %d failed: %w", mark, err)
+				}
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package dns
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindControl(iface string, mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("binding to an interface and SO_MARK are only supported on Linux")
+}
@@ -15,6 +15,8 @@ import (
 	"time"
 
 	D "github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 )
 
 const (
@@ -22,6 +24,45 @@ const (
 	DOHJSONMIMETYPE = "application/dns-json"
 )
 
+// defaultTimeout is the timeout of a query if ClientOptions.Timeout isn't set.
+const defaultTimeout = time.Second * 5
+
+// ClientOptions are the per-upstream options of a client.
+type ClientOptions struct {
+	Timeout time.Duration
+	// DisableTCPRetry keeps the truncated responses of udp upstreams
+	// instead of retrying over tcp
+	DisableTCPRetry bool
+	// TLS applies to tls, https, h3 and quic upstreams
+	TLS *TLSOptions
+	// Proxy is the url of a socks5:// or http:// proxy the upstream
+	// is dialed through, quic and h3 upstreams don't support it
+	Proxy string
+	// Bind is the source ip or the interface the queries leave from
+	Bind string
+	// Mark is the SO_MARK of the sockets, only supported on Linux
+	Mark int
+	// PaddingBlock pads the queries of encrypted upstreams to a
+	// multiple of it, 0 for no padding
+	PaddingBlock int
+}
+
+// paddingBlock returns the padding block size of an upstream, which is
+// 0 unless the transport is encrypted.
+func (o *ClientOptions) paddingBlock(encrypted bool) int {
+	if o == nil || !encrypted {
+		return 0
+	}
+	return o.PaddingBlock
+}
+
+func (o *ClientOptions) timeout() time.Duration {
+	if o == nil || o.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return o.Timeout
+}
+
 type Client interface {
 	Exchange(m *D.Msg) (msg *D.Msg, rtt time.Duration, err error)
 	ExchangeContext(ctx context.Context, m *D.Msg) (msg *D.Msg, rtt time.Duration, err error)
@@ -29,13 +70,26 @@ type Client interface {
 
 type generalClient struct {
 	*D.Client
-	host string
-	port string
+	host   string
+	port   string
+	dialer dialer
+	// pool pipelines the queries over tcp and tcp-tls
+	pool *connPool
+	// tcpPool retries the truncated responses of udp over tcp,
+	// nil if the retry is disabled
+	tcpPool *connPool
+	padding int
+	// cookies are sent to udp upstreams
+	cookies *clientCookies
 }
 
 type httpClient struct {
 	url       string
-	transport *http.Transport
+	transport http.RoundTripper
+	timeout   time.Duration
+	padding   int
+	// addr is the address connected to instead of resolving the url host, if set
+	addr string
 }
 
 type Resolver interface {
@@ -55,6 +109,7 @@ func (r *defaultResolve) ResolveHost(host string) (ip net.IP, err error) {
 	if err != nil {
 		return nil, err
 	}
+	ips = FilterIPs(ips, family)
 
 	num := len(ips)
 	if num == 0 {
@@ -77,6 +132,60 @@ func (c *generalClient) Exchange(m *D.Msg) (result *D.Msg, rtt time.Duration, er
 }
 
 func (c *generalClient) ExchangeContext(ctx context.Context, m *D.Msg) (msg *D.Msg, rtt time.Duration, err error) {
+	if c.pool != nil {
+		ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+		t := time.Now()
+		msg, err = c.pool.ExchangeContext(ctx, padQuery(m, c.padding))
+		return msg, time.Since(t), err
+	}
+
+	msg, rtt, err = c.exchangeUDP(ctx, m)
+	if err == nil && msg.Truncated && c.tcpPool != nil {
+		// retry over TCP to get the whole response
+		tcpCtx, cancel := context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+		t := time.Now()
+		full, tcpErr := c.tcpPool.ExchangeContext(tcpCtx, m)
+		rtt += time.Since(t)
+		if tcpErr != nil {
+			// the truncated response still tells the client to retry over TCP
+			log.Printf("Retry the truncated response of %s over tcp error: %v\n", c.host, tcpErr)
+			return msg, rtt, nil
+		}
+		msg = full
+	}
+	return msg, rtt, err
+}
+
+func (c *generalClient) exchangeUDP(ctx context.Context, m *D.Msg) (msg *D.Msg, rtt time.Duration, err error) {
+	if c.cookies == nil || m.IsEdns0() == nil {
+		return c.exchangeUDPOnce(ctx, m, nil)
+	}
+
+	// a BADCOOKIE response carries a new server cookie,
+	// retry once with it (RFC 7873 section 5.3)
+	for i := 0; i < 2; i++ {
+		q := m.Copy()
+		setCookie(q, c.cookies.cookie())
+		msg, rtt, err = c.exchangeUDPOnce(ctx, q, c.cookies.update)
+		if err != nil {
+			return nil, rtt, err
+		}
+		if msg.Rcode != D.RcodeBadCookie {
+			return msg, rtt, nil
+		}
+	}
+	// the new server cookie isn't accepted either, start over without one
+	c.cookies.reset()
+	return msg, rtt, nil
+}
+
+// exchangeUDPOnce sends m and waits for its response until the timeout.
+// The malformed responses, the ones with another ID and the ones not
+// accepted by accept if it isn't nil are discarded like the responses to
+// earlier queries, so that a spoofed packet can't fail the query.
+func (c *generalClient) exchangeUDPOnce(ctx context.Context, m *D.Msg, accept func(*D.Msg) bool) (msg *D.Msg, rtt time.Duration, err error) {
 	var ip net.IP
 
 	ip, err = resolver.ResolveHost(c.host)
@@ -84,24 +193,47 @@ func (c *generalClient) ExchangeContext(ctx context.Context, m *D.Msg) (msg *D.M
 		return nil, 0, fmt.Errorf("resolve nameserver host failed: %w", err)
 	}
 
-	type result struct {
-		msg *D.Msg
-		rtt time.Duration
-		err error
+	conn, err := c.dialer.DialContext(ctx, c.Net, net.JoinHostPort(ip.String(), c.port))
+	if err != nil {
+		return nil, 0, err
 	}
-
-	ch := make(chan result, 1)
-	go func() {
-		msg, rtt, err = c.Client.Exchange(m, net.JoinHostPort(ip.String(), c.port))
-		ch <- result{msg, rtt, err}
+	co := &D.Conn{Conn: conn, UDPSize: c.UDPSize}
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= D.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	defer func() {
+		_ = co.Close()
 	}()
 
-	select {
-	case <-ctx.Done():
-		return nil, 0, ctx.Err()
-	case ret := <-ch:
-		return ret.msg, ret.rtt, ret.err
+	// closing the connection interrupts the exchange once ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	t := time.Now()
+	_ = co.SetDeadline(t.Add(c.Timeout))
+	if err = co.WriteMsg(m); err == nil {
+		for {
+			msg, err = co.ReadMsg()
+			// the other errors are of malformed packets
+			var netErr net.Error
+			if errors.As(err, &netErr) {
+				break
+			}
+			if err == nil && msg.Id == m.Id && (accept == nil || accept(msg)) {
+				break
+			}
+		}
+	}
+	rtt = time.Since(t)
+	if ctx.Err() != nil {
+		return nil, rtt, ctx.Err()
+	}
+	if err != nil {
+		return nil, rtt, err
 	}
+	return msg, rtt, nil
 }
 
 func (dc *httpClient) Exchange(m *D.Msg) (msg *D.Msg, rtt time.Duration, err error) {
@@ -109,7 +241,10 @@ func (dc *httpClient) Exchange(m *D.Msg) (msg *D.Msg, rtt time.Duration, err err
 }
 
 func (dc *httpClient) ExchangeContext(ctx context.Context, m *D.Msg) (msg *D.Msg, rtt time.Duration, err error) {
-	req, err := dc.newRequest(m)
+	ctx, cancel := context.WithTimeout(ctx, dc.timeout)
+	defer cancel()
+
+	req, err := dc.newRequest(padQuery(m, dc.padding))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -161,13 +296,81 @@ func (dc *httpClient) doRequest(req *http.Request) (msg *D.Msg, rtt time.Duratio
 	return msg, rtt, err
 }
 
-func newHTTPClient(url string) *httpClient {
+func newHTTPClient(addr string, opts *ClientOptions) (*httpClient, error) {
+	parse, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(parse.Hostname(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := newDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &httpClient{
+		url:     addr,
+		timeout: opts.timeout(),
+		padding: opts.paddingBlock(parse.Scheme == "https"),
+	}
+	c.transport = &http.Transport{
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if c.addr != "" {
+				return d.DialContext(ctx, "tcp", c.addr)
+			}
+
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			ip, err := resolver.ResolveHost(host)
+			if err != nil {
+				return nil, fmt.Errorf("resolve nameserver host failed: %w", err)
+			}
+
+			return d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		},
+	}
+	return c, nil
+}
+
+// newHTTP3Client returns a DNS over HTTP/3 client for h3:// urls,
+// which are sent as https:// requests over QUIC.
+func newHTTP3Client(addr string, opts *ClientOptions) (*httpClient, error) {
+	parse, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	parse.Scheme = "https"
+	if opts != nil && opts.Proxy != "" {
+		return nil, errors.New("proxy isn't supported by h3 upstreams")
+	}
+
+	tlsConfig, err := newTLSConfig(parse.Hostname(), opts)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+	d, err := newDirectDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+	qd := &quicDialer{d: d}
+
 	return &httpClient{
-		url: url,
-		transport: &http.Transport{
-			TLSClientConfig:   &tls.Config{},
-			ForceAttemptHTTP2: true,
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		url:     parse.String(),
+		timeout: opts.timeout(),
+		padding: opts.paddingBlock(true),
+		transport: &http3.Transport{
+			TLSClientConfig: tlsConfig,
+			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
 				host, port, err := net.SplitHostPort(addr)
 				if err != nil {
 					return nil, err
@@ -178,31 +381,42 @@ func newHTTPClient(url string) *httpClient {
 					return nil, fmt.Errorf("resolve nameserver host failed: %w", err)
 				}
 
-				return net.Dial("tcp", net.JoinHostPort(ip.String(), port))
+				return qd.DialEarly(ctx, net.JoinHostPort(ip.String(), port), tlsCfg, cfg)
 			},
 		},
-	}
+	}, nil
 }
 
-func newGeneralClient(addr string) *generalClient {
+func newGeneralClient(addr string, opts *ClientOptions) (*generalClient, error) {
 	parse, err := url.Parse(addr)
 	if err != nil {
-		log.Println(err.Error())
-		return nil
+		return nil, err
 	}
 	scheme, host, port := parse.Scheme, parse.Hostname(), parse.Port()
 	if scheme == "tls" {
 		scheme = "tcp-tls"
 	}
+	d, err := newDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if scheme == "tcp-tls" {
+		if tlsConfig, err = newTLSConfig(host, opts); err != nil {
+			return nil, err
+		}
+	}
 	c := &generalClient{
 		Client: &D.Client{
 			Net:       scheme,
-			TLSConfig: &tls.Config{ServerName: host},
+			TLSConfig: tlsConfig,
 			UDPSize:   4096,
-			Timeout:   time.Second * 5,
+			Timeout:   opts.timeout(),
 		},
-		port: port,
-		host: host,
+		port:    port,
+		host:    host,
+		dialer:  d,
+		padding: opts.paddingBlock(scheme == "tcp-tls"),
 	}
 	if c.port == "" {
 		switch scheme {
@@ -214,10 +428,43 @@ func newGeneralClient(addr string) *generalClient {
 			c.port = "853"
 		}
 	}
-	return c
+	switch scheme {
+	case "tcp", "tcp-tls":
+		c.pool = newConnPool(c.dial)
+	case "udp":
+		if opts == nil || !opts.DisableTCPRetry {
+			c.tcpPool = newConnPool(c.dial)
+		}
+		c.cookies = newClientCookies()
+	}
+	return c, nil
+}
+
+// dial connects to the upstream for the connection pool.
+func (c *generalClient) dial(ctx context.Context) (net.Conn, error) {
+	ip, err := resolver.ResolveHost(c.host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve nameserver host failed: %w", err)
+	}
+	addr := net.JoinHostPort(ip.String(), c.port)
+
+	conn, err := c.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.Net != "tcp-tls" {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, c.TLSConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
 
-func NewClient(addr string) (c Client, err error) {
+func NewClient(addr string, opts *ClientOptions) (c Client, err error) {
 	parse, err := url.Parse(addr)
 	if err != nil {
 		return nil, err
@@ -229,8 +476,16 @@ func NewClient(addr string) (c Client, err error) {
 
 	switch parse.Scheme {
 	case "http", "https":
-		return newHTTPClient(addr), nil
+		return newHTTPClient(addr, opts)
+	case "h3":
+		return newHTTP3Client(addr, opts)
+	case "quic":
+		return newQUICClient(addr, opts)
+	case "sdns":
+		return newStampClient(addr, opts)
+	case "recursive":
+		return newRecursiveClient(addr, opts)
 	default:
-		return newGeneralClient(addr), nil
+		return newGeneralClient(addr, opts)
 	}
 }
@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	D "github.com/miekg/dns"
+)
+
+// serveTruncating serves the A queries over UDP with truncated empty
+// responses, and over TCP with the whole answers if withTCP, on the same
+// loopback port. It returns the address and the count of TCP queries.
+func serveTruncating(t *testing.T, withTCP bool) (string, *int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	servers := []*D.Server{{PacketConn: pc, Handler: D.HandlerFunc(func(w D.ResponseWriter, m *D.Msg) {
+		msg := new(D.Msg)
+		msg.SetReply(m)
+		msg.Truncated = true
+		_ = w.WriteMsg(msg)
+	})}}
+
+	var tcpQueries int32
+	if withTCP {
+		lsn, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, &D.Server{Listener: lsn, Handler: D.HandlerFunc(func(w D.ResponseWriter, m *D.Msg) {
+			atomic.AddInt32(&tcpQueries, 1)
+			msg := new(D.Msg)
+			msg.SetReply(m)
+			rr, _ := D.NewRR(m.Question[0].Name + " 300 IN A 192.0.2.1")
+			msg.Answer = append(msg.Answer, rr)
+			_ = w.WriteMsg(msg)
+		})})
+	}
+	for _, srv := range servers {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func(srv *D.Server) {
+			_ = srv.ActivateAndServe()
+		}(srv)
+		<-started
+		t.Cleanup(func() {
+			_ = srv.Shutdown()
+		})
+	}
+	return addr, &tcpQueries
+}
+
+func TestTruncatedRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		withTCP bool
+		disable bool
+		// retried is whether the whole answer is got over TCP
+		retried bool
+	}{
+		{name: "retry", withTCP: true, retried: true},
+		{name: "tcp failure"},
+		{name: "retry disabled", withTCP: true, disable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, tcpQueries := serveTruncating(t, tt.withTCP)
+			c, err := newGeneralClient("udp://"+addr, &ClientOptions{DisableTCPRetry: tt.disable})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := new(D.Msg)
+			m.SetQuestion("example.org.", D.TypeA)
+			msg, _, err := c.Exchange(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.retried {
+				if msg.Truncated || len(msg.Answer) != 1 {
+					t.Errorf("got truncated %t answer %v, want the TCP answer", msg.Truncated, msg.Answer)
+				}
+				return
+			}
+			// the truncated response tells the client to retry itself
+			if !msg.Truncated {
+				t.Error("got a response not truncated")
+			}
+			if n := atomic.LoadInt32(tcpQueries); n != 0 {
+				t.Errorf("%d TCP queries, want none", n)
+			}
+		})
+	}
+}
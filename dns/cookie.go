@@ -0,0 +1,235 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	D "github.com/miekg/dns"
+)
+
+// DNS Cookies (RFC 7873), the server cookies follow the layout of
+// RFC 9018 with an HMAC-SHA256 instead of SipHash.
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16
+	// cookieSecretRotation is how often the server secret changes, the
+	// cookies of the previous secret are still accepted
+	cookieSecretRotation = time.Hour
+	// serverCookieLifetime is how long a server cookie is accepted,
+	// a new one is sent once it is half as old
+	serverCookieLifetime = time.Hour
+	// serverCookieSkew tolerates the cookies from a clock slightly ahead
+	serverCookieSkew = time.Minute * 5
+)
+
+// cookieStatus is the result of checking the COOKIE option of a query.
+type cookieStatus int
+
+const (
+	// cookieNone is a query without COOKIE, or with only a client cookie
+	cookieNone cookieStatus = iota
+	cookieValid
+	cookieBad
+	cookieMalformed
+)
+
+// getCookie returns the COOKIE option of m, or nil if there isn't one.
+func getCookie(m *D.Msg) *D.EDNS0_COOKIE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if c, ok := o.(*D.EDNS0_COOKIE); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// setCookie replaces the COOKIE option of m, m must have an OPT record.
+func setCookie(m *D.Msg, cookie []byte) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*D.EDNS0_COOKIE); !ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, &D.EDNS0_COOKIE{Code: D.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+}
+
+// cookieServer issues and checks the server cookies of a listener.
+type cookieServer struct {
+	mu       sync.Mutex
+	current  []byte
+	previous []byte
+	rotated  time.Time
+}
+
+func newCookieServer() *cookieServer {
+	s := new(cookieServer)
+	s.rotate(time.Now())
+	return s
+}
+
+func (s *cookieServer) rotate(now time.Time) {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	s.previous, s.current = s.current, secret
+	s.rotated = now
+}
+
+// secrets returns the current and the previous secrets,
+// rotating them when it's time to.
+func (s *cookieServer) secrets(now time.Time) (current, previous []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.rotated) >= cookieSecretRotation {
+		s.rotate(now)
+	}
+	return s.current, s.previous
+}
+
+// serverCookie returns the server cookie of a client at t,
+// which is version 1, 3 reserved octets, the timestamp and the hash.
+func serverCookie(secret, clientCookie []byte, ip net.IP, t time.Time) []byte {
+	b := make([]byte, serverCookieLen)
+	b[0] = 1
+	binary.BigEndian.PutUint32(b[4:8], uint32(t.Unix()))
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(clientCookie)
+	mac.Write(b[:8])
+	mac.Write(ip.To16())
+	copy(b[8:], mac.Sum(nil))
+	return b
+}
+
+// check checks the COOKIE option of a query from ip, and returns the
+// cookie for the response, nil if the query has no COOKIE option.
+func (s *cookieServer) check(m *D.Msg, ip net.IP) (cookieStatus, []byte) {
+	option := getCookie(m)
+	if option == nil {
+		return cookieNone, nil
+	}
+	cookie, err := hex.DecodeString(option.Cookie)
+	// a client cookie, and an optional server cookie of 8 to 32 octets
+	if err != nil || len(cookie) != clientCookieLen &&
+		(len(cookie) < clientCookieLen+8 || len(cookie) > clientCookieLen+32) {
+		return cookieMalformed, nil
+	}
+
+	now := time.Now()
+	current, previous := s.secrets(now)
+	clientCookie := cookie[:clientCookieLen]
+	reply := append(clientCookie[:clientCookieLen:clientCookieLen], serverCookie(current, clientCookie, ip, now)...)
+
+	if len(cookie) == clientCookieLen {
+		return cookieNone, reply
+	}
+
+	sc := cookie[clientCookieLen:]
+	if len(sc) != serverCookieLen || sc[0] != 1 {
+		return cookieBad, reply
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(sc[4:8])), 0)
+	if issued.After(now.Add(serverCookieSkew)) || now.Sub(issued) > serverCookieLifetime {
+		return cookieBad, reply
+	}
+	for _, secret := range [][]byte{current, previous} {
+		if secret != nil && bytes.Equal(sc, serverCookie(secret, clientCookie, ip, issued)) {
+			// keep the cookie until it is half as old as the lifetime
+			if now.Sub(issued) < serverCookieLifetime/2 {
+				return cookieValid, cookie
+			}
+			return cookieValid, reply
+		}
+	}
+	return cookieBad, reply
+}
+
+// cookieResponseWriter adds the server cookie to the responses.
+type cookieResponseWriter struct {
+	*generalResponseWriter
+	cookie []byte
+	// size is the largest response the client accepts
+	size int
+}
+
+func (w *cookieResponseWriter) WriteMsg(m *D.Msg) error {
+	if m.IsEdns0() != nil {
+		setCookie(m, w.cookie)
+		m.Truncate(w.size)
+	}
+	return w.generalResponseWriter.WriteMsg(m)
+}
+
+// clientCookies keeps the cookies of a client to one upstream.
+type clientCookies struct {
+	mu     sync.Mutex
+	client []byte
+	server []byte
+}
+
+func newClientCookies() *clientCookies {
+	c := &clientCookies{client: make([]byte, clientCookieLen)}
+	_, _ = rand.Read(c.client)
+	return c
+}
+
+// cookie returns the COOKIE option content for the next query.
+func (c *clientCookies) cookie() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append(append([]byte{}, c.client...), c.server...)
+}
+
+// update checks the COOKIE option of a response, which must echo the
+// client cookie, and remembers the server cookie. A response without
+// COOKIE is only accepted until the upstream has sent a server cookie,
+// the upstreams not supporting cookies never send one. Then such a
+// response is discarded, and the server cookie is forgotten in case the
+// upstream has stopped supporting cookies (RFC 7873 section 5.3).
+func (c *clientCookies) update(m *D.Msg) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	option := getCookie(m)
+	if option == nil {
+		if c.server == nil {
+			return true
+		}
+		c.server = nil
+		return false
+	}
+	cookie, err := hex.DecodeString(option.Cookie)
+	if err != nil || len(cookie) < clientCookieLen+8 || len(cookie) > clientCookieLen+32 {
+		return false
+	}
+	if !bytes.Equal(cookie[:clientCookieLen], c.client) {
+		return false
+	}
+	c.server = append([]byte{}, cookie[clientCookieLen:]...)
+	return true
+}
+
+// reset forgets the server cookie, which the upstream doesn't accept.
+func (c *clientCookies) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.server = nil
+}
@@ -0,0 +1,195 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	D "github.com/miekg/dns"
+)
+
+// cookieQuery returns a query with the COOKIE option of cookie, hex
+// encoded unless it is a string.
+func cookieQuery(cookie interface{}) *D.Msg {
+	m := new(D.Msg)
+	m.SetQuestion("example.org.", D.TypeA)
+	m.SetEdns0(4096, false)
+	switch c := cookie.(type) {
+	case []byte:
+		setCookie(m, c)
+	case string:
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &D.EDNS0_COOKIE{Code: D.EDNS0COOKIE, Cookie: c})
+	}
+	return m
+}
+
+func TestCookieServerCheck(t *testing.T) {
+	s := newCookieServer()
+	now := time.Now()
+	ip := net.ParseIP("192.0.2.1")
+	client := []byte("clientck")
+	withServer := func(secret []byte, ip net.IP, issued time.Time) []byte {
+		return append(append([]byte{}, client...), serverCookie(secret, client, ip, issued)...)
+	}
+	fresh := withServer(s.current, ip, now)
+	halfOld := withServer(s.current, ip, now.Add(-serverCookieLifetime/2-time.Minute))
+	wrongVersion := append([]byte{}, fresh...)
+	wrongVersion[clientCookieLen] = 2
+
+	tests := []struct {
+		name   string
+		cookie interface{}
+		status cookieStatus
+		// kept is whether the cookie of the query is sent back
+		kept bool
+	}{
+		{name: "no cookie", status: cookieNone},
+		{name: "client cookie", cookie: client, status: cookieNone},
+		{name: "fresh", cookie: fresh, status: cookieValid, kept: true},
+		{name: "half old", cookie: halfOld, status: cookieValid},
+		{name: "expired", cookie: withServer(s.current, ip, now.Add(-serverCookieLifetime-time.Minute)), status: cookieBad},
+		{name: "future", cookie: withServer(s.current, ip, now.Add(serverCookieSkew+time.Minute)), status: cookieBad},
+		{name: "other address", cookie: withServer(s.current, net.ParseIP("192.0.2.2"), now), status: cookieBad},
+		{name: "other secret", cookie: withServer([]byte("secret"), ip, now), status: cookieBad},
+		{name: "wrong version", cookie: wrongVersion, status: cookieBad},
+		{name: "short server cookie", cookie: append(append([]byte{}, client...), make([]byte, 8)...), status: cookieBad},
+		{name: "short", cookie: client[:7], status: cookieMalformed},
+		{name: "server cookie too short", cookie: append(append([]byte{}, client...), make([]byte, 7)...), status: cookieMalformed},
+		{name: "server cookie too long", cookie: append(append([]byte{}, client...), make([]byte, 33)...), status: cookieMalformed},
+		{name: "not hex", cookie: "not hex", status: cookieMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reply := s.check(cookieQuery(tt.cookie), ip)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d", status, tt.status)
+			}
+			switch {
+			case tt.cookie == nil || status == cookieMalformed:
+				if reply != nil {
+					t.Errorf("cookie %x sent back", reply)
+				}
+			case tt.kept:
+				if !bytes.Equal(reply, tt.cookie.([]byte)) {
+					t.Errorf("cookie %x sent back, want the one of the query", reply)
+				}
+			default:
+				// a new server cookie for the client cookie of the query
+				if len(reply) != clientCookieLen+serverCookieLen || !bytes.Equal(reply[:clientCookieLen], client) {
+					t.Errorf("cookie %x sent back", reply)
+				}
+				if status, _ := s.check(cookieQuery(reply), ip); status != cookieValid {
+					t.Errorf("new cookie %x not valid", reply)
+				}
+			}
+		})
+	}
+
+	// the cookies of the previous secret are accepted, not older ones
+	s.rotate(now)
+	if status, _ := s.check(cookieQuery(fresh), ip); status != cookieValid {
+		t.Error("cookie of the previous secret not valid")
+	}
+	s.rotate(now)
+	if status, _ := s.check(cookieQuery(fresh), ip); status != cookieBad {
+		t.Error("cookie of an older secret valid")
+	}
+}
+
+func TestClientCookiesUpdate(t *testing.T) {
+	c := newClientCookies()
+	server := bytes.Repeat([]byte{1}, serverCookieLen)
+	other := bytes.Repeat([]byte{2}, serverCookieLen)
+	with := func(server []byte) []byte {
+		return append(append([]byte{}, c.client...), server...)
+	}
+
+	steps := []struct {
+		name   string
+		cookie interface{}
+		ok     bool
+		// server is the server cookie sent next
+		server []byte
+	}{
+		{name: "no cookie before any", ok: true},
+		{name: "server cookie", cookie: with(server), ok: true, server: server},
+		{name: "other client cookie", cookie: append([]byte("otherclt"), other...), server: server},
+		{name: "client cookie only", cookie: c.client, server: server},
+		{name: "not hex", cookie: "not hex", server: server},
+		{name: "new server cookie", cookie: with(other), ok: true, server: other},
+		// the upstream may have stopped supporting cookies
+		{name: "no cookie", server: nil},
+		{name: "no cookie again", ok: true, server: nil},
+	}
+	for _, step := range steps {
+		if ok := c.update(cookieQuery(step.cookie)); ok != step.ok {
+			t.Errorf("%s: accepted %t, want %t", step.name, ok, step.ok)
+		}
+		if got := c.cookie(); !bytes.Equal(got, with(step.server)) {
+			t.Errorf("%s: next cookie %x, want %x", step.name, got, with(step.server))
+		}
+	}
+}
+
+func TestBadCookieRetry(t *testing.T) {
+	// the upstream never accepts the server cookies it sends
+	var mu sync.Mutex
+	var sent []string
+	addr := serveUDP(t, func(w D.ResponseWriter, m *D.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, getCookie(m).Cookie)
+		msg := new(D.Msg)
+		msg.SetRcode(m, D.RcodeBadCookie)
+		msg.SetEdns0(4096, false)
+		cookie, _ := hex.DecodeString(getCookie(m).Cookie)
+		setCookie(msg, append(cookie[:clientCookieLen:clientCookieLen], bytes.Repeat([]byte{byte(len(sent))}, serverCookieLen)...))
+		_ = w.WriteMsg(msg)
+	})
+	c, err := newGeneralClient("udp://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(D.Msg)
+	m.SetQuestion("example.org.", D.TypeA)
+	m.SetEdns0(4096, false)
+	msg, _, err := c.Exchange(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if msg.Rcode != D.RcodeBadCookie || len(sent) != 2 {
+		t.Fatalf("rcode %s after %d queries, want BADCOOKIE after the retry", D.RcodeToString[msg.Rcode], len(sent))
+	}
+	if len(sent[1]) != 2*(clientCookieLen+serverCookieLen) {
+		t.Errorf("retry with cookie %s, want the new server cookie", sent[1])
+	}
+	if cookie := c.cookies.cookie(); len(cookie) != clientCookieLen {
+		t.Errorf("next cookie %x, want the client cookie only", cookie)
+	}
+}
+
+// serveUDP serves handler on a loopback UDP port, and returns its address.
+func serveUDP(t *testing.T, handler D.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &D.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = srv.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
@@ -0,0 +1,423 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	D "github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Encryption systems of DNSCrypt certificates
+const (
+	dnscryptXSalsa20Poly1305  = 0x0001
+	dnscryptXChacha20Poly1305 = 0x0002
+)
+
+const (
+	dnscryptCertMinLen  = 124
+	dnscryptMinQueryLen = 256
+	dnscryptPadBlock    = 64
+	// dnscryptCertRefresh is how often the certificates are fetched
+	// again, to pick up the rotated ones before the old expires
+	dnscryptCertRefresh = time.Hour
+)
+
+var (
+	dnscryptCertMagic     = []byte{0x44, 0x4e, 0x53, 0x43}
+	dnscryptResolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+)
+
+// dnscryptCert is a verified DNSCrypt v2 resolver certificate.
+type dnscryptCert struct {
+	esVersion   uint16
+	resolverPk  [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+}
+
+// dnscryptClient is a DNSCrypt v2 client, the server certificate is
+// fetched with a TXT query for the provider name and verified with the
+// provider public key of the stamp.
+type dnscryptClient struct {
+	addr         string
+	providerName string
+	serverPk     ed25519.PublicKey
+	timeout      time.Duration
+	dialer       dialer
+
+	mu        sync.Mutex
+	cert      *dnscryptCert
+	fetchedAt time.Time
+}
+
+func newDNSCryptClient(st *stamp, opts *ClientOptions) (*dnscryptClient, error) {
+	if st.addr == "" {
+		return nil, fmt.Errorf("%w: DNSCrypt stamp without address", errInvalidStamp)
+	}
+	d, err := newDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &dnscryptClient{
+		addr:         st.addr,
+		providerName: D.Fqdn(st.providerName),
+		serverPk:     ed25519.PublicKey(st.serverPk),
+		timeout:      opts.timeout(),
+		dialer:       d,
+	}, nil
+}
+
+// txtBytes returns the binary content of a TXT record,
+// decoding the escapes of miekg/dns.
+func txtBytes(txt *D.TXT) []byte {
+	var buf bytes.Buffer
+	for _, s := range txt.Txt {
+		for i := 0; i < len(s); i++ {
+			if s[i] != '\\' || i+1 >= len(s) {
+				buf.WriteByte(s[i])
+				continue
+			}
+			if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+				n, _ := strconv.Atoi(s[i+1 : i+4])
+				buf.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+			buf.WriteByte(s[i+1])
+			i++
+		}
+	}
+	return buf.Bytes()
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// parseDNSCryptCert parses and verifies a certificate.
+func parseDNSCryptCert(b []byte, serverPk ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(b) < dnscryptCertMinLen || !bytes.Equal(b[:4], dnscryptCertMagic) {
+		return nil, errors.New("invalid DNSCrypt certificate")
+	}
+
+	cert := &dnscryptCert{esVersion: binary.BigEndian.Uint16(b[4:6])}
+	if cert.esVersion != dnscryptXSalsa20Poly1305 && cert.esVersion != dnscryptXChacha20Poly1305 {
+		return nil, fmt.Errorf("unsupported DNSCrypt encryption system %d", cert.esVersion)
+	}
+
+	signature, signed := b[8:72], b[72:]
+	if !ed25519.Verify(serverPk, signed, signature) {
+		return nil, errors.New("invalid DNSCrypt certificate signature")
+	}
+
+	copy(cert.resolverPk[:], b[72:104])
+	copy(cert.clientMagic[:], b[104:112])
+	cert.serial = binary.BigEndian.Uint32(b[112:116])
+	cert.notBefore = time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0)
+
+	return cert, nil
+}
+
+// fetchCert fetches the certificates and returns the valid one with the
+// highest serial, preferring XChacha20 for the same serial.
+func (c *dnscryptClient) fetchCert(ctx context.Context) (*dnscryptCert, error) {
+	m := new(D.Msg)
+	m.SetQuestion(c.providerName, D.TypeTXT)
+	m.SetEdns0(4096, false)
+
+	msg, err := c.exchangePlain(ctx, m, "udp")
+	if err == nil && msg.Truncated {
+		msg, err = c.exchangePlain(ctx, m, "tcp")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetch DNSCrypt certificate failed: %w", err)
+	}
+
+	now := time.Now()
+	var best *dnscryptCert
+	for _, rr := range msg.Answer {
+		txt, ok := rr.(*D.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := parseDNSCryptCert(txtBytes(txt), c.serverPk)
+		if err != nil {
+			log.Printf("DNSCrypt %s: %v\n", c.providerName, err)
+			continue
+		}
+		if now.Before(cert.notBefore) || now.After(cert.notAfter) {
+			continue
+		}
+		if best == nil || cert.serial > best.serial ||
+			(cert.serial == best.serial && cert.esVersion > best.esVersion) {
+			best = cert
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no valid DNSCrypt certificate for %s", c.providerName)
+	}
+	return best, nil
+}
+
+// exchangePlain sends an unencrypted query to the server.
+func (c *dnscryptClient) exchangePlain(ctx context.Context, m *D.Msg, network string) (*D.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	conn, err := c.dialer.DialContext(ctx, network, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	dc := &D.Conn{Conn: conn, UDPSize: 4096}
+	if err = dc.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	return dc.ReadMsg()
+}
+
+// getCert returns the current certificate, fetching a new one if it
+// has expired or hasn't been refreshed for a while.
+func (c *dnscryptClient) getCert(ctx context.Context) (*dnscryptCert, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.cert != nil && now.Before(c.cert.notAfter) && now.Sub(c.fetchedAt) < dnscryptCertRefresh {
+		return c.cert, nil
+	}
+
+	cert, err := c.fetchCert(ctx)
+	if err != nil {
+		if c.cert != nil && now.Before(c.cert.notAfter) {
+			// keep using the current certificate until it expires
+			log.Println(err.Error())
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert = cert
+	c.fetchedAt = now
+
+	return cert, nil
+}
+
+// sharedKey computes the key shared with the resolver.
+func (cert *dnscryptCert) sharedKey(sk *[32]byte) (key [32]byte, err error) {
+	if cert.esVersion == dnscryptXSalsa20Poly1305 {
+		box.Precompute(&key, &cert.resolverPk, sk)
+		return key, nil
+	}
+
+	shared, err := curve25519.X25519(sk[:], cert.resolverPk[:])
+	if err != nil {
+		return key, err
+	}
+	shared, err = chacha20.HChaCha20(shared, make([]byte, 16))
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], shared)
+	return key, nil
+}
+
+// seal encrypts in the secretbox format, tag followed by the ciphertext.
+func (cert *dnscryptCert) seal(msg []byte, nonce *[24]byte, key *[32]byte) []byte {
+	if cert.esVersion == dnscryptXSalsa20Poly1305 {
+		return secretbox.Seal(nil, msg, nonce, key)
+	}
+
+	// XChacha20 keystream, the first 32 bytes are the Poly1305 key
+	buf := make([]byte, 32+len(msg))
+	copy(buf[32:], msg)
+	cipher, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	cipher.XORKeyStream(buf, buf)
+
+	var polyKey [32]byte
+	copy(polyKey[:], buf[:32])
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, buf[32:], &polyKey)
+
+	return append(tag[:], buf[32:]...)
+}
+
+// open decrypts a box sealed by seal.
+func (cert *dnscryptCert) open(box []byte, nonce *[24]byte, key *[32]byte) ([]byte, bool) {
+	if cert.esVersion == dnscryptXSalsa20Poly1305 {
+		return secretbox.Open(nil, box, nonce, key)
+	}
+
+	if len(box) < poly1305.TagSize {
+		return nil, false
+	}
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], box[:poly1305.TagSize])
+
+	buf := make([]byte, 32+len(box)-poly1305.TagSize)
+	copy(buf[32:], box[poly1305.TagSize:])
+	cipher, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+
+	var polyKey [32]byte
+	cipher.XORKeyStream(polyKey[:], polyKey[:])
+	if !poly1305.Verify(&tag, buf[32:], &polyKey) {
+		return nil, false
+	}
+
+	cipher, _ = chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	cipher.XORKeyStream(buf, buf)
+	return buf[32:], true
+}
+
+// dnscryptPad pads a query with 0x80 and zeros (ISO/IEC 7816-4).
+func dnscryptPad(b []byte, minLen int) []byte {
+	n := len(b) + 1
+	if n < minLen {
+		n = minLen
+	}
+	n = (n + dnscryptPadBlock - 1) / dnscryptPadBlock * dnscryptPadBlock
+
+	padded := make([]byte, n)
+	copy(padded, b)
+	padded[len(b)] = 0x80
+	return padded
+}
+
+func dnscryptUnpad(b []byte) ([]byte, error) {
+	i := bytes.LastIndexByte(b, 0x80)
+	if i < 0 {
+		return nil, errors.New("invalid DNSCrypt padding")
+	}
+	for _, c := range b[i+1:] {
+		if c != 0 {
+			return nil, errors.New("invalid DNSCrypt padding")
+		}
+	}
+	return b[:i], nil
+}
+
+func (c *dnscryptClient) Exchange(m *D.Msg) (msg *D.Msg, rtt time.Duration, err error) {
+	return c.ExchangeContext(context.Background(), m)
+}
+
+func (c *dnscryptClient) ExchangeContext(ctx context.Context, m *D.Msg) (msg *D.Msg, rtt time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	cert, err := c.getCert(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	t := time.Now()
+	msg, err = c.exchange(ctx, cert, m, "udp")
+	if err == nil && msg.Truncated {
+		msg, err = c.exchange(ctx, cert, m, "tcp")
+	}
+	return msg, time.Since(t), err
+}
+
+func (c *dnscryptClient) exchange(ctx context.Context, cert *dnscryptCert, m *D.Msg, network string) (*D.Msg, error) {
+	// an ephemeral key pair for every query
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cert.sharedKey(sk)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	if _, err = rand.Read(nonce[:12]); err != nil {
+		return nil, err
+	}
+
+	query, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	minLen := dnscryptMinQueryLen
+	if network == "tcp" {
+		minLen = 0
+	}
+
+	packet := make([]byte, 0, 8+32+12+len(query)+dnscryptMinQueryLen)
+	packet = append(packet, cert.clientMagic[:]...)
+	packet = append(packet, pk[:]...)
+	packet = append(packet, nonce[:12]...)
+	packet = append(packet, cert.seal(dnscryptPad(query, minLen), &nonce, &key)...)
+
+	conn, err := c.dialer.DialContext(ctx, network, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	dc := &D.Conn{Conn: conn, UDPSize: 4096}
+	if _, err = dc.Write(packet); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, D.MaxMsgSize)
+	n, err := dc.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	resp := buf[:n]
+
+	if len(resp) < 8+24+poly1305.TagSize || !bytes.Equal(resp[:8], dnscryptResolverMagic) {
+		return nil, errors.New("invalid DNSCrypt response")
+	}
+	var respNonce [24]byte
+	copy(respNonce[:], resp[8:32])
+	if !bytes.Equal(respNonce[:12], nonce[:12]) {
+		return nil, errors.New("DNSCrypt response nonce mismatch")
+	}
+
+	plain, ok := cert.open(resp[32:], &respNonce, &key)
+	if !ok {
+		return nil, errors.New("DNSCrypt response decryption failed")
+	}
+	if plain, err = dnscryptUnpad(plain); err != nil {
+		return nil, err
+	}
+
+	msg := new(D.Msg)
+	if err = msg.Unpack(plain); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
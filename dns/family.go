@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+)
+
+// Address family modes, for the networks where one of IPv4 and IPv6 is
+// broken or slow
+const (
+	// FamilyAny keeps both of the A and AAAA records
+	FamilyAny = "any"
+	// IPv4Only drops the AAAA records
+	IPv4Only = "ipv4-only"
+	// PreferIPv4 drops the AAAA records of the names with A records
+	PreferIPv4 = "prefer-ipv4"
+	// PreferIPv6 drops the A records of the names with AAAA records
+	PreferIPv6 = "prefer-ipv6"
+	// IPv6Only drops the A records
+	IPv6Only = "ipv6-only"
+)
+
+// CheckFamily returns an error if mode isn't an address family mode,
+// an empty one is FamilyAny.
+func CheckFamily(mode string) error {
+	switch mode {
+	case "", FamilyAny, IPv4Only, PreferIPv4, PreferIPv6, IPv6Only:
+		return nil
+	}
+	return fmt.Errorf("invalid address family mode: %s", mode)
+}
+
+// FilterIPs returns the IPs of ips kept by the address family mode.
+func FilterIPs(ips []net.IP, mode string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch mode {
+	case IPv4Only:
+		return v4
+	case PreferIPv4:
+		if len(v4) > 0 {
+			return v4
+		}
+	case PreferIPv6:
+		if len(v6) > 0 {
+			return v6
+		}
+	case IPv6Only:
+		return v6
+	}
+	return ips
+}
+
+// family is the address family mode of the hosts resolved by the
+// system resolver.
+var family string
+
+// SetFamily sets the address family mode of the upstream hosts resolved
+// without a resolver set by SetResolver.
+func SetFamily(mode string) {
+	family = mode
+}
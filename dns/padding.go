@@ -0,0 +1,44 @@
+package dns
+
+import (
+	D "github.com/miekg/dns"
+)
+
+// Block sizes of EDNS(0) padding recommended by RFC 8467 section 4.1
+const (
+	DefaultQueryPaddingBlock    = 128
+	DefaultResponsePaddingBlock = 468
+)
+
+// Pad adds the EDNS(0) padding option (RFC 7830) to m, so that its
+// length is a multiple of block. It does nothing if m has no OPT record
+// or block isn't positive.
+func Pad(m *D.Msg, block int) {
+	opt := m.IsEdns0()
+	if opt == nil || block <= 0 {
+		return
+	}
+
+	options := opt.Option[:0:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*D.EDNS0_PADDING); !ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+
+	// the option code and length take 4 octets
+	n := m.Len() + 4
+	padding := (block - n%block) % block
+	opt.Option = append(opt.Option, &D.EDNS0_PADDING{Padding: make([]byte, padding)})
+}
+
+// padQuery returns a padded copy of m, or m itself if block isn't positive.
+func padQuery(m *D.Msg, block int) *D.Msg {
+	if block <= 0 || m.IsEdns0() == nil {
+		return m
+	}
+	m = m.Copy()
+	Pad(m, block)
+	return m
+}
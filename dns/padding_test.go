@@ -0,0 +1,70 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	D "github.com/miekg/dns"
+)
+
+func paddingOptions(m *D.Msg) (n int) {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if _, ok := o.(*D.EDNS0_PADDING); ok {
+				n++
+			}
+		}
+	}
+	return
+}
+
+func TestPad(t *testing.T) {
+	names := []string{"a.", "example.org.", strings.Repeat("abcdefgh.", 20)}
+	for _, block := range []int{DefaultQueryPaddingBlock, DefaultResponsePaddingBlock, 1, 7} {
+		for _, name := range names {
+			m := new(D.Msg)
+			m.SetQuestion(name, D.TypeA)
+			m.SetEdns0(4096, true)
+			// an earlier padding, like the one of the upstream, is replaced
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &D.EDNS0_PADDING{Padding: make([]byte, 5)})
+			rr, _ := D.NewRR(name + " 300 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+
+			Pad(m, block)
+			buf, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf)%block != 0 {
+				t.Errorf("block %d, %s: length %d", block, name, len(buf))
+			}
+			if n := paddingOptions(m); n != 1 {
+				t.Errorf("block %d, %s: %d padding options", block, name, n)
+			}
+		}
+	}
+
+	m := new(D.Msg)
+	m.SetQuestion("example.org.", D.TypeA)
+	Pad(m, DefaultQueryPaddingBlock)
+	if m.IsEdns0() != nil {
+		t.Error("padded without OPT record")
+	}
+}
+
+func TestPadQuery(t *testing.T) {
+	m := new(D.Msg)
+	m.SetQuestion("example.org.", D.TypeA)
+	m.SetEdns0(4096, false)
+
+	if q := padQuery(m, 0); q != m || paddingOptions(q) != 0 {
+		t.Error("padded with block 0")
+	}
+	q := padQuery(m, DefaultQueryPaddingBlock)
+	if paddingOptions(q) != 1 || q.Len()%DefaultQueryPaddingBlock != 0 {
+		t.Errorf("query of %d octets not padded", q.Len())
+	}
+	if paddingOptions(m) != 0 {
+		t.Error("the query of the client is padded")
+	}
+}
@@ -0,0 +1,263 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	D "github.com/miekg/dns"
+)
+
+// pipelineMaxInflight is the number of queries in flight on one
+// connection before another connection is opened
+const pipelineMaxInflight = 64
+
+// pipelineIdleTimeout closes the connections without queries for a while
+var pipelineIdleTimeout = time.Second * 30
+
+var errPipelineClosed = errors.New("connection closed")
+
+// pipelineConn is a TCP or TLS connection to an upstream, on which
+// several queries are in flight at once, the responses are matched by
+// message ID as RFC 7766 section 6.2.1.1 allows.
+type pipelineConn struct {
+	conn *D.Conn
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]*pendingQuery
+	closed  bool
+	// stale is set once a query timed out, the connection may be dead,
+	// it takes no more queries and is closed when the others are done
+	stale bool
+}
+
+type pendingQuery struct {
+	question D.Question
+	ch       chan *D.Msg
+}
+
+// connPool keeps the pipelined connections to one upstream.
+type connPool struct {
+	dial func(ctx context.Context) (net.Conn, error)
+
+	mu    sync.Mutex
+	conns []*pipelineConn
+}
+
+func newConnPool(dial func(ctx context.Context) (net.Conn, error)) *connPool {
+	return &connPool{dial: dial}
+}
+
+// get returns a connection with room for one more query,
+// or dials a new one.
+func (p *connPool) get(ctx context.Context) (*pipelineConn, error) {
+	// dial with the lock held, so that the concurrent queries
+	// share the new connection instead of dialing their own
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pc := range p.conns {
+		if pc.inflight() < pipelineMaxInflight {
+			return pc, nil
+		}
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc := &pipelineConn{
+		conn:    &D.Conn{Conn: conn},
+		pending: make(map[uint16]*pendingQuery),
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(pipelineIdleTimeout))
+	p.conns = append(p.conns, pc)
+
+	go func() {
+		pc.readLoop()
+		p.remove(pc)
+	}()
+
+	return pc, nil
+}
+
+func (p *connPool) remove(pc *pipelineConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, c := range p.conns {
+		if c == pc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// ExchangeContext sends m on a pooled connection and waits for the
+// response until ctx is done.
+func (p *connPool) ExchangeContext(ctx context.Context, m *D.Msg) (*D.Msg, error) {
+	pc, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := pc.exchange(ctx, m)
+	if errors.Is(err, errPipelineClosed) && ctx.Err() == nil {
+		// the upstream may close idle connections at any time (RFC 7766
+		// section 6.2.3), retry once on a new connection
+		if pc, err = p.get(ctx); err != nil {
+			return nil, err
+		}
+		msg, err = pc.exchange(ctx, m)
+	}
+	return msg, err
+}
+
+func (pc *pipelineConn) inflight() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.closed || pc.stale {
+		return pipelineMaxInflight
+	}
+	return len(pc.pending)
+}
+
+// register reserves an unused message ID for a query.
+func (pc *pipelineConn) register(m *D.Msg) (uint16, chan *D.Msg, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.closed {
+		return 0, nil, errPipelineClosed
+	}
+
+	var id uint16
+	for {
+		id = uint16(rand.Intn(0x10000))
+		if _, ok := pc.pending[id]; !ok {
+			break
+		}
+	}
+	ch := make(chan *D.Msg, 1)
+	pc.pending[id] = &pendingQuery{m.Question[0], ch}
+
+	// the queries time out by themselves, not by the read deadline,
+	// which only closes the idle connection
+	if len(pc.pending) == 1 {
+		_ = pc.conn.SetReadDeadline(time.Time{})
+	}
+
+	return id, ch, nil
+}
+
+// unregister releases the ID of a query, timedOut marks the connection
+// stale.
+func (pc *pipelineConn) unregister(id uint16, timedOut bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	delete(pc.pending, id)
+	if timedOut {
+		pc.stale = true
+	}
+	if len(pc.pending) > 0 || pc.closed {
+		return
+	}
+	if pc.stale {
+		pc.closeLocked()
+		return
+	}
+	_ = pc.conn.SetReadDeadline(time.Now().Add(pipelineIdleTimeout))
+}
+
+func (pc *pipelineConn) exchange(ctx context.Context, m *D.Msg) (*D.Msg, error) {
+	if len(m.Question) == 0 {
+		return nil, errors.New("should have one question at least")
+	}
+
+	id, ch, err := pc.register(m)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		pc.unregister(id, errors.Is(err, context.DeadlineExceeded))
+	}()
+
+	// queries from different clients may have the same ID
+	q := m.Copy()
+	q.Id = id
+
+	pc.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = pc.conn.SetWriteDeadline(deadline)
+	}
+	err = pc.conn.WriteMsg(q)
+	pc.writeMu.Unlock()
+	if err != nil {
+		pc.close()
+		return nil, errPipelineClosed
+	}
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return nil, err
+	case msg, ok := <-ch:
+		if !ok {
+			return nil, errPipelineClosed
+		}
+		msg.Id = m.Id
+		return msg, nil
+	}
+}
+
+func (pc *pipelineConn) readLoop() {
+	defer pc.close()
+
+	for {
+		// an error is the idle timeout or the connection closed
+		msg, err := pc.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+
+		pc.mu.Lock()
+		// a late response of a cancelled query may have the ID of a new one
+		p, ok := pc.pending[msg.Id]
+		if ok && (len(msg.Question) == 0 || strings.EqualFold(msg.Question[0].Name, p.question.Name) &&
+			msg.Question[0].Qtype == p.question.Qtype) {
+			delete(pc.pending, msg.Id)
+			p.ch <- msg
+		}
+		if len(pc.pending) == 0 {
+			_ = pc.conn.SetReadDeadline(time.Now().Add(pipelineIdleTimeout))
+		}
+		pc.mu.Unlock()
+	}
+}
+
+// close closes the connection and fails the queries in flight.
+func (pc *pipelineConn) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.closeLocked()
+}
+
+func (pc *pipelineConn) closeLocked() {
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	_ = pc.conn.Close()
+	for id, p := range pc.pending {
+		close(p.ch)
+		delete(pc.pending, id)
+	}
+}
@@ -0,0 +1,198 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	D "github.com/miekg/dns"
+)
+
+// serveTCP serves each connection to a loopback listener with handle,
+// and returns a pool dialing it.
+func serveTCP(t *testing.T, handle func(conn *D.Conn)) *connPool {
+	t.Helper()
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = lsn.Close()
+	})
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(&D.Conn{Conn: conn})
+			}()
+		}
+	}()
+	return newConnPool(func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", lsn.Addr().String())
+	})
+}
+
+func reply(conn *D.Conn, m *D.Msg) {
+	msg := new(D.Msg)
+	msg.SetReply(m)
+	rr, _ := D.NewRR(m.Question[0].Name + " 300 IN A 192.0.2.1")
+	msg.Answer = append(msg.Answer, rr)
+	_ = conn.WriteMsg(msg)
+}
+
+// exchangeNames sends the queries of names at once, and returns their
+// errors in order.
+func exchangeNames(p *connPool, timeout time.Duration, names ...string) []error {
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			m := new(D.Msg)
+			m.SetQuestion(name, D.TypeA)
+			m.Id = uint16(1000 + i)
+			msg, err := p.ExchangeContext(ctx, m)
+			if err == nil && (msg.Id != m.Id || msg.Question[0].Name != name) {
+				err = errors.New("response of another query")
+			}
+			errs[i] = err
+		}(i, name)
+		// the queries are sent in order
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestPipelineOutOfOrder(t *testing.T) {
+	p := serveTCP(t, func(conn *D.Conn) {
+		first, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		second, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		reply(conn, second)
+		reply(conn, first)
+	})
+
+	for i, err := range exchangeNames(p, time.Second, "a.example.", "b.example.") {
+		if err != nil {
+			t.Errorf("query %d: %v", i, err)
+		}
+	}
+}
+
+func TestPipelineLostResponse(t *testing.T) {
+	var queries int32
+	p := serveTCP(t, func(conn *D.Conn) {
+		for {
+			m, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&queries, 1)
+			// the response to lost.example. is lost, the others go on
+			if m.Question[0].Name != "lost.example." {
+				reply(conn, m)
+			}
+		}
+	})
+
+	// the other queries keep the connection busy past the timeout
+	done := make(chan []error)
+	go func() {
+		done <- exchangeNames(p, 200*time.Millisecond, "lost.example.")
+	}()
+	for i := 0; i < 30; i++ {
+		if errs := exchangeNames(p, time.Second, "ok.example."); errs[0] != nil {
+			t.Fatalf("other query: %v", errs[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case errs := <-done:
+		if !errors.Is(errs[0], context.DeadlineExceeded) {
+			t.Errorf("lost query got %v, want the timeout", errs[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lost query never times out")
+	}
+	// sent once, a timeout isn't retried
+	if n := atomic.LoadInt32(&queries); n != 31 {
+		t.Errorf("%d queries sent, want 31", n)
+	}
+}
+
+func TestPipelineClosedByPeer(t *testing.T) {
+	var conns int32
+	p := serveTCP(t, func(conn *D.Conn) {
+		// the first connection is closed with the query in flight
+		if atomic.AddInt32(&conns, 1) == 1 {
+			_, _ = conn.ReadMsg()
+			return
+		}
+		for {
+			m, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			reply(conn, m)
+		}
+	})
+
+	if errs := exchangeNames(p, time.Second, "a.example."); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("%d connections, want a retry on a second one", n)
+	}
+}
+
+func TestPipelineIdleClose(t *testing.T) {
+	defer func(d time.Duration) { pipelineIdleTimeout = d }(pipelineIdleTimeout)
+	pipelineIdleTimeout = 100 * time.Millisecond
+
+	closed := make(chan struct{})
+	p := serveTCP(t, func(conn *D.Conn) {
+		for {
+			m, err := conn.ReadMsg()
+			if err != nil {
+				close(closed)
+				return
+			}
+			reply(conn, m)
+		}
+	})
+
+	if errs := exchangeNames(p, time.Second, "a.example."); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+	time.Sleep(10 * time.Millisecond)
+	p.mu.Lock()
+	n := len(p.conns)
+	p.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d connections kept, want none", n)
+	}
+}
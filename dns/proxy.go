@@ -0,0 +1,397 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialer dials the connections to an upstream, directly or through a proxy.
+type dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newDialer returns the dialer of an upstream.
+func newDialer(opts *ClientOptions) (dialer, error) {
+	d, err := newDirectDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil || opts.Proxy == "" {
+		return d, nil
+	}
+
+	parse, err := url.Parse(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	if parse.Port() == "" {
+		return nil, fmt.Errorf("proxy %s without port", opts.Proxy)
+	}
+
+	switch parse.Scheme {
+	case "socks5":
+		pd := &socks5Dialer{addr: parse.Host, forward: d}
+		if parse.User != nil {
+			pd.user = parse.User.Username()
+			pd.password, _ = parse.User.Password()
+			// the lengths are single octets (RFC 1929 section 2)
+			if len(pd.user) > 255 || len(pd.password) > 255 {
+				return nil, fmt.Errorf("proxy %s: user or password longer than 255 bytes", parse.Redacted())
+			}
+		}
+		return pd, nil
+	case "http":
+		pd := &httpProxyDialer{addr: parse.Host, forward: d}
+		if parse.User != nil {
+			password, _ := parse.User.Password()
+			pd.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(parse.User.Username()+":"+password))
+		}
+		return pd, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy %s", opts.Proxy)
+}
+
+// handshake runs f on conn with the deadline and the cancellation of ctx.
+func handshake(ctx context.Context, conn net.Conn, f func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	// an expired deadline interrupts f once ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	err := f()
+	if !stop() {
+		return ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return err
+}
+
+// httpProxyDialer dials TCP connections through an HTTP CONNECT proxy.
+type httpProxyDialer struct {
+	addr    string
+	auth    string
+	forward *directDialer
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("http proxy doesn't support %s", network)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	err = handshake(ctx, conn, func() error {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if d.auth != "" {
+			req.Header.Set("Proxy-Authorization", d.auth)
+		}
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("proxy CONNECT %s failed: %s", addr, resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the data buffered while reading the CONNECT response first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// SOCKS5 (RFC 1928, RFC 1929)
+const (
+	socks5Version         = 0x05
+	socks5AuthNone        = 0x00
+	socks5AuthPassword    = 0x02
+	socks5AuthNoAccept    = 0xff
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+	socks5AtypIPv4        = 0x01
+	socks5AtypDomain      = 0x03
+	socks5AtypIPv6        = 0x04
+)
+
+// socks5Dialer dials TCP connections through a SOCKS5 proxy with CONNECT,
+// and UDP connections with UDP ASSOCIATE.
+type socks5Dialer struct {
+	addr     string
+	user     string
+	password string
+	forward  *directDialer
+}
+
+// socks5Addr encodes addr as ATYP, DST.ADDR and DST.PORT.
+func socks5Addr(addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host %s too long", host)
+		}
+		b = append([]byte{socks5AtypDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socks5AtypIPv4}, ip4...)
+	} else {
+		b = append([]byte{socks5AtypIPv6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(p)), nil
+}
+
+// readSocks5Addr reads ATYP, ADDR and PORT.
+func readSocks5Addr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", fmt.Errorf("invalid SOCKS5 address type %d", atyp[0])
+	}
+
+	var port uint16
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// connect negotiates the authentication and sends a command,
+// returning the bound address of the reply.
+func (d *socks5Dialer) connect(conn net.Conn, cmd byte, addr string) (string, error) {
+	method := byte(socks5AuthNone)
+	if d.user != "" {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return "", err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return "", err
+	}
+	if reply[0] != socks5Version {
+		return "", errors.New("invalid SOCKS5 version")
+	}
+	if reply[1] == socks5AuthNoAccept || reply[1] != method {
+		return "", errors.New("no acceptable SOCKS5 authentication method")
+	}
+
+	if method == socks5AuthPassword {
+		b := []byte{0x01, byte(len(d.user))}
+		b = append(b, d.user...)
+		b = append(b, byte(len(d.password)))
+		b = append(b, d.password...)
+		if _, err := conn.Write(b); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return "", err
+		}
+		if reply[1] != 0x00 {
+			return "", errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	dst, err := socks5Addr(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err = conn.Write(append([]byte{socks5Version, cmd, 0x00}, dst...)); err != nil {
+		return "", err
+	}
+
+	var head [3]byte
+	if _, err = io.ReadFull(conn, head[:]); err != nil {
+		return "", err
+	}
+	if head[1] != 0x00 {
+		return "", fmt.Errorf("SOCKS5 request to %s failed with reply %d", addr, head[1])
+	}
+	return readSocks5Addr(conn)
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var cmd byte
+	target := addr
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		cmd = socks5CmdConnect
+	case "udp", "udp4", "udp6":
+		cmd = socks5CmdUDPAssociate
+		// the address the datagrams are sent from is unknown yet
+		target = "0.0.0.0:0"
+	default:
+		return nil, fmt.Errorf("socks5 proxy doesn't support %s", network)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var bound string
+	err = handshake(ctx, conn, func() (err error) {
+		bound, err = d.connect(conn, cmd, target)
+		return err
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if cmd == socks5CmdConnect {
+		return conn, nil
+	}
+
+	// the relay may be reported as unspecified, meaning the proxy itself
+	host, port, _ := net.SplitHostPort(bound)
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		proxyHost, _, _ := net.SplitHostPort(d.addr)
+		bound = net.JoinHostPort(proxyHost, port)
+	}
+
+	header, err := socks5Addr(addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	relay, err := d.forward.DialContext(ctx, "udp", bound)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &socks5UDPConn{
+		Conn:   relay,
+		ctrl:   conn,
+		header: append([]byte{0x00, 0x00, 0x00}, header...),
+	}, nil
+}
+
+// socks5UDPConn sends the datagrams to one address through a SOCKS5
+// UDP relay, the association lasts as long as the control connection.
+// It is a net.PacketConn, so that D.Conn reads and writes whole datagrams.
+type socks5UDPConn struct {
+	net.Conn
+	ctrl   net.Conn
+	header []byte
+}
+
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	buf := append(append(make([]byte, 0, len(c.header)+len(b)), c.header...), b...)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		r := bytes.NewReader(buf[:n])
+		var head [3]byte
+		if _, err = io.ReadFull(r, head[:]); err != nil {
+			continue
+		}
+		// fragments are not supported, drop them
+		if head[2] != 0x00 {
+			continue
+		}
+		if _, err = readSocks5Addr(r); err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), nil
+	}
+}
+
+func (c *socks5UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *socks5UDPConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *socks5UDPConn) Close() error {
+	_ = c.ctrl.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,316 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-reuseport"
+	D "github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// Error codes of DNS over QUIC (RFC 9250 section 4.3)
+const (
+	DOQNoError          = 0x0
+	DOQInternalError    = 0x1
+	DOQProtocolError    = 0x2
+	DOQRequestCancelled = 0x3
+)
+
+var doqALPN = []string{"doq"}
+
+// quicClient is a DNS over QUIC client, which sends every query
+// on a new stream of one shared connection.
+type quicClient struct {
+	host      string
+	port      string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	dialer    *quicDialer
+	padding   int
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+// readDOQMsg reads a message with the 2-octet length prefix from a stream.
+func readDOQMsg(r io.Reader) (*D.Msg, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	m := new(D.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeDOQMsg writes a message with the 2-octet length prefix to a stream.
+func writeDOQMsg(w io.Writer, m *D.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	msg := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(msg, uint16(len(buf)))
+	copy(msg[2:], buf)
+
+	_, err = w.Write(msg)
+	return err
+}
+
+func (c *quicClient) Exchange(m *D.Msg) (msg *D.Msg, rtt time.Duration, err error) {
+	return c.ExchangeContext(context.Background(), m)
+}
+
+func (c *quicClient) ExchangeContext(ctx context.Context, m *D.Msg) (msg *D.Msg, rtt time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	t := time.Now()
+	msg, err = c.exchange(ctx, m)
+	if errors.Is(err, errQUICConnClosed) {
+		// the shared connection was closed by the server or timed out,
+		// try again on a new one
+		msg, err = c.exchange(ctx, m)
+	}
+	return msg, time.Since(t), err
+}
+
+var errQUICConnClosed = errors.New("quic connection closed")
+
+func (c *quicClient) exchange(ctx context.Context, m *D.Msg) (*D.Msg, error) {
+	conn, err := c.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		if conn.Context().Err() != nil {
+			return nil, fmt.Errorf("%w: %v", errQUICConnClosed, err)
+		}
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(DOQRequestCancelled)
+		stream.CancelWrite(DOQRequestCancelled)
+	})
+	defer stop()
+
+	// the message ID must be 0 in DNS over QUIC
+	q := m.Copy()
+	Pad(q, c.padding)
+	q.Id = 0
+	if err = writeDOQMsg(stream, q); err != nil {
+		return nil, err
+	}
+	// close the sending direction to indicate there is no more query
+	if err = stream.Close(); err != nil {
+		return nil, err
+	}
+
+	msg, err := readDOQMsg(stream)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// the server may have dropped the connection silently,
+			// don't reuse it
+			_ = conn.CloseWithError(DOQNoError, "")
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if conn.Context().Err() != nil {
+			return nil, fmt.Errorf("%w: %v", errQUICConnClosed, err)
+		}
+		return nil, err
+	}
+	msg.Id = m.Id
+
+	return msg, nil
+}
+
+// getConn returns the shared connection, or dials a new one if it
+// has been closed.
+func (c *quicClient) getConn(ctx context.Context) (*quic.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil && c.conn.Context().Err() == nil {
+		return c.conn, nil
+	}
+
+	ip, err := resolver.ResolveHost(c.host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve nameserver host failed: %w", err)
+	}
+
+	// dial early so that queries can be sent in 0-RTT when resuming
+	conn, err := c.dialer.DialEarly(ctx, net.JoinHostPort(ip.String(), c.port), c.tlsConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+
+	return conn, nil
+}
+
+func newQUICClient(addr string, opts *ClientOptions) (*quicClient, error) {
+	parse, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts != nil && opts.Proxy != "" {
+		return nil, errors.New("proxy isn't supported by quic upstreams")
+	}
+
+	tlsConfig, err := newTLSConfig(parse.Hostname(), opts)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.NextProtos = doqALPN
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+	d, err := newDirectDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &quicClient{
+		host:      parse.Hostname(),
+		port:      parse.Port(),
+		tlsConfig: tlsConfig,
+		timeout:   opts.timeout(),
+		dialer:    &quicDialer{d: d},
+		padding:   opts.paddingBlock(true),
+	}
+	if c.port == "" {
+		c.port = "853"
+	}
+
+	return c, nil
+}
+
+type quicResponseWriter struct {
+	stream *quic.Stream
+}
+
+// Write sends b as the response and closes the stream,
+// there is only one response on a stream.
+func (w quicResponseWriter) Write(b []byte) (int, error) {
+	msg := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(msg, uint16(len(b)))
+	copy(msg[2:], b)
+
+	if _, err := w.stream.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), w.stream.Close()
+}
+
+func (w quicResponseWriter) WriteMsg(m *D.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func serveQUICStream(conn *quic.Conn, stream *quic.Stream, handler Handler) {
+	m, err := readDOQMsg(stream)
+	if err != nil {
+		log.Println(err.Error())
+		stream.CancelRead(DOQProtocolError)
+		stream.CancelWrite(DOQProtocolError)
+		return
+	}
+	// a query with a non-zero message ID is a protocol error (RFC 9250 section 4.2.1)
+	if m.Id != 0 {
+		_ = conn.CloseWithError(DOQProtocolError, "message ID must be 0")
+		return
+	}
+
+	q := &Query{
+		Msg: m,
+		Remote: &remote{
+			Addr: conn.RemoteAddr().String(),
+		},
+	}
+	handler.ServeDNS(quicResponseWriter{stream}, q)
+}
+
+func serveQUICConn(conn *quic.Conn, handler Handler) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go serveQUICStream(conn, stream, handler)
+	}
+}
+
+// ListenQUICAndServe serves DNS over QUIC, the idle timeout and the
+// number of concurrent streams per connection use the defaults of quic-go if 0.
+func ListenQUICAndServe(addr, certFile, keyFile string, idleTimeout time.Duration, maxStreams int64, handler Handler) error {
+	tlsConfig, err := loadCertFile(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig.NextProtos = doqALPN
+
+	pkt, err := reuseport.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	// the stateless reset lets clients notice the connections
+	// closed by the idle timeout at once
+	var key quic.StatelessResetKey
+	if _, err = rand.Read(key[:]); err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: pkt, StatelessResetKey: &key}
+
+	lsn, err := tr.ListenEarly(tlsConfig, &quic.Config{
+		MaxIdleTimeout:     idleTimeout,
+		MaxIncomingStreams: maxStreams,
+		Allow0RTT:          true,
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := lsn.Accept(context.Background())
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			go serveQUICConn(conn, handler)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	D "github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func TestQUICClient(t *testing.T) {
+	ca := newTestCert(t, "test CA", true, nil)
+	leaf := newTestCert(t, "doq.test", false, ca)
+
+	lsn, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{leaf.tlsCertificate()},
+		NextProtos:   []string{"doq"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsn.Close()
+
+	ids := make(chan uint16, 1)
+	go func() {
+		conn, err := lsn.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		// the query has the 2-octet length prefix, and ends the stream
+		var length uint16
+		if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+			t.Error(err)
+			return
+		}
+		buf, err := io.ReadAll(stream)
+		if err != nil || len(buf) != int(length) {
+			t.Errorf("query of %d octets, got %d: %v", length, len(buf), err)
+			return
+		}
+		m := new(D.Msg)
+		if err := m.Unpack(buf); err != nil {
+			t.Error(err)
+			return
+		}
+		ids <- m.Id
+
+		reply := new(D.Msg)
+		reply.SetReply(m)
+		rr, _ := D.NewRR("example.org. 300 IN A 192.0.2.1")
+		reply.Answer = append(reply.Answer, rr)
+		out, _ := reply.Pack()
+		_ = binary.Write(stream, binary.BigEndian, uint16(len(out)))
+		_, _ = stream.Write(out)
+		_ = stream.Close()
+	}()
+
+	_, port, _ := net.SplitHostPort(lsn.Addr().String())
+	c, err := newQUICClient("quic://127.0.0.1:"+port, &ClientOptions{
+		TLS: &TLSOptions{ServerName: "doq.test", CAFile: ca.writePEM(t)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(D.Msg)
+	m.SetQuestion("example.org.", D.TypeA)
+	m.Id = 1234
+	msg, _, err := c.Exchange(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := <-ids; id != 0 {
+		t.Errorf("message ID %d sent, want 0", id)
+	}
+	if msg.Id != 1234 {
+		t.Errorf("message ID %d of the response, want the one of the query", msg.Id)
+	}
+	if len(msg.Answer) != 1 || msg.Answer[0].(*D.A).A.String() != "192.0.2.1" {
+		t.Errorf("unexpected answer %v", msg.Answer)
+	}
+}
@@ -0,0 +1,596 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	LEC "github.com/zekexy/leedns/cache"
+	D "github.com/miekg/dns"
+)
+
+// rootHints are the root servers of the IANA root hints file.
+var rootHints = map[string][]string{
+	"a.root-servers.net.": {"198.41.0.4", "2001:503:ba3e::2:30"},
+	"b.root-servers.net.": {"170.247.170.2", "2801:1b8:10::b"},
+	"c.root-servers.net.": {"192.33.4.12", "2001:500:2::c"},
+	"d.root-servers.net.": {"199.7.91.13", "2001:500:2d::d"},
+	"e.root-servers.net.": {"192.203.230.10", "2001:500:a8::e"},
+	"f.root-servers.net.": {"192.5.5.241", "2001:500:2f::f"},
+	"g.root-servers.net.": {"192.112.36.4", "2001:500:12::d0d"},
+	"h.root-servers.net.": {"198.97.190.53", "2001:500:1::53"},
+	"i.root-servers.net.": {"192.36.148.17", "2001:7fe::53"},
+	"j.root-servers.net.": {"192.58.128.30", "2001:503:c27::2:30"},
+	"k.root-servers.net.": {"193.0.14.129", "2001:7fd::1"},
+	"l.root-servers.net.": {"199.7.83.42", "2001:500:9f::42"},
+	"m.root-servers.net.": {"202.12.27.33", "2001:dc3::35"},
+}
+
+const (
+	// maxReferrals limits the delegations followed for a name
+	maxReferrals = 30
+	// maxCNAMEs limits the CNAMEs followed across zones
+	maxCNAMEs = 8
+	// maxNSDepth limits the nested resolutions of the name server addresses
+	maxNSDepth = 4
+	// maxMinimise is the most labels added one by one with QNAME
+	// minimisation, the rest are sent at once (RFC 9156 section 2.3)
+	maxMinimise = 10
+	// serverTimeout is the timeout of a query to an authoritative server
+	serverTimeout = time.Second * 2
+	// maxDelegationTTL is the longest time a delegation is cached
+	maxDelegationTTL = time.Hour * 24
+	// maxCachedZones is the most delegations and name server addresses
+	// cached, the least recently used ones are evicted
+	maxCachedZones = 4096
+)
+
+// delegation is the name servers of a zone, the ones without addresses
+// are resolved when needed.
+type delegation struct {
+	zone    string
+	servers []string
+	expire  time.Time
+}
+
+// recursiveClient resolves the queries iteratively from the root servers
+// instead of forwarding them to a resolver.
+type recursiveClient struct {
+	dialer  dialer
+	timeout time.Duration
+	root    *delegation
+	// hints are the addresses of the root servers, which never expire
+	hints map[string][]string
+
+	// delegations are the zone cuts found, by zone
+	delegations *LEC.LruExpiresCache
+	// addrs are the addresses of the name servers, by name
+	addrs *LEC.LruExpiresCache
+}
+
+func newRecursiveClient(addr string, opts *ClientOptions) (*recursiveClient, error) {
+	parse, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	delegations, err := LEC.New(maxCachedZones)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := LEC.New(maxCachedZones)
+	if err != nil {
+		return nil, err
+	}
+	c := &recursiveClient{
+		dialer:      d,
+		timeout:     opts.timeout(),
+		delegations: delegations,
+		addrs:       addrs,
+	}
+
+	hints := rootHints
+	// recursive:///path/named.root loads the root hints from the file
+	if parse.Path != "" {
+		if hints, err = loadRootHints(parse.Path); err != nil {
+			return nil, err
+		}
+	}
+	c.root = &delegation{zone: "."}
+	for name := range hints {
+		c.root.servers = append(c.root.servers, name)
+	}
+	c.hints = hints
+	return c, nil
+}
+
+// loadRootHints reads the NS records of the root and their addresses
+// from a root hints file like named.root.
+func loadRootHints(file string) (map[string][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	var servers []string
+	addrs := make(map[string][]string)
+	zp := D.NewZoneParser(f, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := D.CanonicalName(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *D.NS:
+			if name == "." {
+				servers = append(servers, D.CanonicalName(rr.Ns))
+			}
+		case *D.A:
+			addrs[name] = append(addrs[name], rr.A.String())
+		case *D.AAAA:
+			addrs[name] = append(addrs[name], rr.AAAA.String())
+		}
+	}
+	if err = zp.Err(); err != nil {
+		return nil, err
+	}
+
+	hints := make(map[string][]string)
+	for _, s := range servers {
+		if len(addrs[s]) > 0 {
+			hints[s] = addrs[s]
+		}
+	}
+	if len(hints) == 0 {
+		return nil, fmt.Errorf("no root server address in %s", file)
+	}
+	return hints, nil
+}
+
+func (c *recursiveClient) Exchange(m *D.Msg) (msg *D.Msg, rtt time.Duration, err error) {
+	return c.ExchangeContext(context.Background(), m)
+}
+
+func (c *recursiveClient) ExchangeContext(ctx context.Context, m *D.Msg) (msg *D.Msg, rtt time.Duration, err error) {
+	if len(m.Question) == 0 {
+		return nil, 0, errors.New("should have one question at least")
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	t := time.Now()
+	q := m.Question[0]
+	do := false
+	if opt := m.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	msg, err = c.resolveChain(ctx, D.CanonicalName(q.Name), q.Qtype, do, 0)
+	if err != nil {
+		return nil, time.Since(t), err
+	}
+	// SetReply resets the rcode, keep the one from the answer
+	rcode := msg.Rcode
+	msg.SetReply(m)
+	msg.Rcode = rcode
+	msg.RecursionAvailable = true
+	msg.Authoritative = false
+	return msg, time.Since(t), nil
+}
+
+// resolveChain resolves name and follows the CNAMEs of the answer to
+// other zones, the answers of the chain are joined.
+func (c *recursiveClient) resolveChain(ctx context.Context, name string, qtype uint16, do bool, depth int) (*D.Msg, error) {
+	ret := new(D.Msg)
+	target := name
+	for i := 0; i <= maxCNAMEs; i++ {
+		msg, err := c.resolve(ctx, target, qtype, do, depth)
+		if err != nil {
+			return nil, err
+		}
+		ret.Answer = append(ret.Answer, msg.Answer...)
+		ret.Ns, ret.Extra = msg.Ns, extraWithoutOPT(msg.Extra)
+		ret.Rcode = msg.Rcode
+
+		if qtype == D.TypeCNAME || msg.Rcode != D.RcodeSuccess {
+			return ret, nil
+		}
+		next := cnameTarget(msg.Answer, target, qtype)
+		if next == "" {
+			return ret, nil
+		}
+		target = next
+	}
+	return nil, fmt.Errorf("CNAME chain of %s too long", name)
+}
+
+// cnameTarget returns the target the CNAMEs of the answer to name end
+// with, empty if there is none or the answer has the records of qtype.
+func cnameTarget(answer []D.RR, name string, qtype uint16) string {
+	target := ""
+	for i := 0; i < maxCNAMEs; i++ {
+		next := ""
+		for _, rr := range answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				return ""
+			}
+			if cname, ok := rr.(*D.CNAME); ok {
+				next = D.CanonicalName(cname.Target)
+			}
+		}
+		if next == "" {
+			return target
+		}
+		name, target = next, next
+	}
+	return target
+}
+
+// inZone returns the records of rrs at or under zone.
+func inZone(rrs []D.RR, zone string) (ret []D.RR) {
+	for _, rr := range rrs {
+		if D.IsSubDomain(zone, rr.Header().Name) {
+			ret = append(ret, rr)
+		}
+	}
+	return
+}
+
+func extraWithoutOPT(extra []D.RR) (ret []D.RR) {
+	for _, rr := range extra {
+		if rr.Header().Rrtype != D.TypeOPT {
+			ret = append(ret, rr)
+		}
+	}
+	return
+}
+
+// closest returns the cached delegation of the closest zone above name,
+// only strictly above for DS, which is in the parent zone.
+func (c *recursiveClient) closest(name string, qtype uint16) *delegation {
+	now := time.Now()
+	zone := name
+	if qtype == D.TypeDS && zone != "." {
+		zone = parentZone(zone)
+	}
+	for {
+		if d, expire, ok := c.delegations.Get(zone); ok && now.Before(expire) {
+			return d.(*delegation)
+		}
+		if zone == "." {
+			return c.root
+		}
+		zone = parentZone(zone)
+	}
+}
+
+func parentZone(name string) string {
+	i, end := D.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+// minimise returns the name sent to the servers of zone for name,
+// one label below the zone (RFC 9156), and whether it is minimised.
+func minimise(zone, name string, qtype uint16) (string, bool) {
+	labels := D.SplitDomainName(name)
+	below := len(labels) - D.CountLabel(zone)
+	// a DS is asked to the parent, which the servers of zone are
+	if below <= 1 {
+		return name, false
+	}
+	if below > maxMinimise {
+		return name, false
+	}
+	return strings.Join(labels[len(labels)-D.CountLabel(zone)-1:], ".") + ".", true
+}
+
+// resolve resolves name from the closest known zone, following the
+// referrals down to the zone of name.
+func (c *recursiveClient) resolve(ctx context.Context, name string, qtype uint16, do bool, depth int) (*D.Msg, error) {
+	d := c.closest(name, qtype)
+	// from is the longest name known to be in the zone of d
+	from := d.zone
+	minimising := true
+
+	for i := 0; i < maxReferrals; i++ {
+		qname, minimised := name, false
+		if minimising {
+			qname, minimised = minimise(from, name, qtype)
+		}
+		t := qtype
+		// RFC 9156 section 3 suggests A for the minimised queries
+		if minimised {
+			t = D.TypeA
+		}
+
+		msg, err := c.queryZone(ctx, d, qname, t, do, depth)
+		if err != nil {
+			if minimised {
+				minimising = false
+				continue
+			}
+			return nil, err
+		}
+
+		if ref := c.referral(msg, from, qname); ref != nil && !(qtype == D.TypeDS && ref.zone == name) {
+			c.cacheDelegation(msg, ref, d.zone)
+			d, from = ref, ref.zone
+			continue
+		}
+
+		if !minimised {
+			// the servers of d answer only for their zone, the records
+			// of other zones are resolved from their own
+			msg.Answer = inZone(msg.Answer, d.zone)
+			return msg, nil
+		}
+		// some servers answer NXDOMAIN for the empty non-terminals,
+		// ask the whole name instead (RFC 9156 section 2.3)
+		if msg.Rcode != D.RcodeSuccess {
+			minimising = false
+			continue
+		}
+		// the name is in the zone of d, go on with one more label
+		from = qname
+	}
+	return nil, fmt.Errorf("too many referrals resolving %s", name)
+}
+
+// referral returns the delegation of the response to qname, nil if msg
+// isn't a referral to a zone below the name zone.
+func (c *recursiveClient) referral(msg *D.Msg, zone, qname string) *delegation {
+	if msg.Rcode != D.RcodeSuccess || len(msg.Answer) > 0 {
+		return nil
+	}
+	var ref *delegation
+	var ttl uint32
+	for _, rr := range msg.Ns {
+		ns, ok := rr.(*D.NS)
+		if !ok {
+			continue
+		}
+		child := D.CanonicalName(ns.Hdr.Name)
+		// a referral goes down, to a zone containing qname
+		if child == zone || !D.IsSubDomain(zone, child) || !D.IsSubDomain(child, qname) {
+			continue
+		}
+		if ref == nil {
+			ref = &delegation{zone: child}
+			ttl = ns.Hdr.Ttl
+		}
+		if child == ref.zone {
+			ref.servers = append(ref.servers, D.CanonicalName(ns.Ns))
+		}
+	}
+	if ref == nil {
+		return nil
+	}
+	d := time.Duration(ttl) * time.Second
+	if d > maxDelegationTTL {
+		d = maxDelegationTTL
+	}
+	ref.expire = time.Now().Add(d)
+	return ref
+}
+
+// cacheDelegation caches the delegation ref of the referral msg from
+// the servers of the parent zone, with the glue in its bailiwick.
+func (c *recursiveClient) cacheDelegation(msg *D.Msg, ref *delegation, parent string) {
+	c.delegations.Add(ref.zone, ref, ref.expire)
+
+	glue := make(map[string][]string)
+	ttls := make(map[string]uint32)
+	for _, rr := range msg.Extra {
+		name := D.CanonicalName(rr.Header().Name)
+		// the glue outside the bailiwick could poison the cache
+		if !D.IsSubDomain(parent, name) {
+			continue
+		}
+		isServer := false
+		for _, s := range ref.servers {
+			if s == name {
+				isServer = true
+				break
+			}
+		}
+		if !isServer {
+			continue
+		}
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *D.A:
+			ip = rr.A
+		case *D.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if _, ok := glue[name]; !ok {
+			ttls[name] = rr.Header().Ttl
+		}
+		glue[name] = append(glue[name], ip.String())
+	}
+	for name, addrs := range glue {
+		c.addrs.Add(name, addrs, time.Now().Add(time.Duration(ttls[name])*time.Second))
+	}
+}
+
+// serverAddrs returns the cached addresses of the servers of d.
+func (c *recursiveClient) serverAddrs(d *delegation) (addrs []string, missing []string) {
+	now := time.Now()
+	for _, s := range d.servers {
+		if a, ok := c.hints[s]; ok {
+			addrs = append(addrs, a...)
+			continue
+		}
+		if a, expire, ok := c.addrs.Get(s); ok && now.Before(expire) {
+			addrs = append(addrs, a.([]string)...)
+		} else {
+			missing = append(missing, s)
+		}
+	}
+	return
+}
+
+// lookupServer resolves the addresses of the name server ns.
+func (c *recursiveClient) lookupServer(ctx context.Context, ns string, depth int) []string {
+	if depth >= maxNSDepth {
+		return nil
+	}
+
+	var addrs []string
+	var ttl uint32
+	for _, t := range []uint16{D.TypeA, D.TypeAAAA} {
+		msg, err := c.resolveChain(ctx, ns, t, false, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range msg.Answer {
+			switch rr := rr.(type) {
+			case *D.A:
+				addrs = append(addrs, rr.A.String())
+				ttl = rr.Hdr.Ttl
+			case *D.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+				ttl = rr.Hdr.Ttl
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		c.addrs.Add(ns, addrs, time.Now().Add(time.Duration(ttl)*time.Second))
+	}
+	return addrs
+}
+
+// orderAddrs shuffles the addresses, with the IPv4 ones first.
+func orderAddrs(addrs []string) []string {
+	var v4, v6 []string
+	for _, a := range addrs {
+		if strings.Contains(a, ":") {
+			v6 = append(v6, a)
+		} else {
+			v4 = append(v4, a)
+		}
+	}
+	rand.Shuffle(len(v4), func(i, j int) { v4[i], v4[j] = v4[j], v4[i] })
+	rand.Shuffle(len(v6), func(i, j int) { v6[i], v6[j] = v6[j], v6[i] })
+	return append(v4, v6...)
+}
+
+// queryZone asks the servers of d one by one until one answers.
+func (c *recursiveClient) queryZone(ctx context.Context, d *delegation, qname string, qtype uint16, do bool, depth int) (*D.Msg, error) {
+	addrs, missing := c.serverAddrs(d)
+	if len(addrs) == 0 {
+		for _, ns := range missing {
+			// a server in the zone itself without glue can't be resolved
+			if D.IsSubDomain(d.zone, ns) {
+				continue
+			}
+			if addrs = c.lookupServer(ctx, ns, depth); len(addrs) > 0 {
+				break
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address of the name servers of %s", d.zone)
+	}
+
+	err := fmt.Errorf("no name server of %s answers %s", d.zone, qname)
+	for _, addr := range orderAddrs(addrs) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		msg, e := c.queryServer(ctx, net.JoinHostPort(addr, "53"), qname, qtype, do)
+		if e != nil {
+			err = e
+			continue
+		}
+		switch msg.Rcode {
+		case D.RcodeSuccess, D.RcodeNameError:
+			return msg, nil
+		}
+		err = fmt.Errorf("%s answers %s for %s", addr, D.RcodeToString[msg.Rcode], qname)
+	}
+	return nil, err
+}
+
+// randomCase randomizes the case of the letters of name (draft-vixie-dnsext-dns0x20).
+func randomCase(name string) string {
+	b := []byte(name)
+	for i, ch := range b {
+		if ('a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z') && rand.Intn(2) == 0 {
+			b[i] ^= 0x20
+		}
+	}
+	return string(b)
+}
+
+// queryServer sends the query to an authoritative server over udp, and
+// over tcp if the response is truncated.
+func (c *recursiveClient) queryServer(ctx context.Context, addr, qname string, qtype uint16, do bool) (*D.Msg, error) {
+	m := new(D.Msg)
+	m.SetQuestion(randomCase(qname), qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(1232, do)
+
+	msg, err := c.exchangeServer(ctx, "udp", addr, m)
+	if err == nil && msg.Truncated {
+		msg, err = c.exchangeServer(ctx, "tcp", addr, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the spoofed responses hardly guess the case of the question
+	if len(msg.Question) != 1 || msg.Question[0].Name != m.Question[0].Name || msg.Question[0].Qtype != qtype {
+		return nil, fmt.Errorf("the question of the response from %s mismatches", addr)
+	}
+	return msg, nil
+}
+
+func (c *recursiveClient) exchangeServer(ctx context.Context, network, addr string, m *D.Msg) (*D.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, serverTimeout)
+	defer cancel()
+
+	conn, err := c.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	co := &D.Conn{Conn: conn, UDPSize: 1232}
+	defer func() {
+		_ = co.Close()
+	}()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client := &D.Client{Net: network, UDPSize: 1232}
+	msg, _, err := client.ExchangeWithConn(m, co)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return msg, err
+}
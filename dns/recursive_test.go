@@ -0,0 +1,366 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	D "github.com/miekg/dns"
+)
+
+// authZone is a zone answered by a test server, the NS records below its
+// apex are delegations.
+type authZone struct {
+	name    string
+	records []D.RR
+	// extra are added to the referrals, like the glue of another bailiwick
+	extra []D.RR
+	// forged are added to the answers, like the records of another zone
+	forged []D.RR
+	// nxENT answers NXDOMAIN for the empty non-terminals like some
+	// broken servers
+	nxENT bool
+}
+
+func newAuthZone(t *testing.T, name string, records ...string) *authZone {
+	t.Helper()
+	z := &authZone{name: name, records: parseRRs(t, name+" 300 IN SOA ns.invalid. admin.invalid. 1 3600 600 86400 300")}
+	z.records = append(z.records, parseRRs(t, records...)...)
+	return z
+}
+
+func parseRRs(t *testing.T, records ...string) (rrs []D.RR) {
+	t.Helper()
+	for _, s := range records {
+		rr, err := D.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return
+}
+
+// answer answers m like an authoritative server of z.
+func (z *authZone) answer(m *D.Msg) *D.Msg {
+	q := m.Question[0]
+	name := D.CanonicalName(q.Name)
+	msg := new(D.Msg)
+	msg.SetReply(m)
+
+	// the referral to the closest delegation above name
+	cut := ""
+	for _, rr := range z.records {
+		owner := D.CanonicalName(rr.Header().Name)
+		if _, ok := rr.(*D.NS); !ok || owner == z.name || !D.IsSubDomain(owner, name) ||
+			q.Qtype == D.TypeDS && owner == name {
+			continue
+		}
+		if cut == "" || D.CountLabel(owner) > D.CountLabel(cut) {
+			cut = owner
+		}
+	}
+	if cut != "" {
+		for _, rr := range z.records {
+			if ns, ok := rr.(*D.NS); ok && D.CanonicalName(ns.Hdr.Name) == cut {
+				msg.Ns = append(msg.Ns, rr)
+				for _, glue := range z.records {
+					if t := glue.Header().Rrtype; (t == D.TypeA || t == D.TypeAAAA) &&
+						D.CanonicalName(glue.Header().Name) == D.CanonicalName(ns.Ns) {
+						msg.Extra = append(msg.Extra, glue)
+					}
+				}
+			}
+		}
+		msg.Extra = append(msg.Extra, z.extra...)
+		return msg
+	}
+
+	msg.Authoritative = true
+	exists, own := false, false
+	for _, rr := range z.records {
+		owner := D.CanonicalName(rr.Header().Name)
+		if owner == name {
+			own = true
+			if t := rr.Header().Rrtype; t == q.Qtype || t == D.TypeCNAME {
+				msg.Answer = append(msg.Answer, rr)
+			}
+		}
+		if D.IsSubDomain(name, owner) {
+			exists = true
+		}
+	}
+	if len(msg.Answer) > 0 {
+		msg.Answer = append(msg.Answer, z.forged...)
+		return msg
+	}
+	if !exists || z.nxENT && !own {
+		msg.Rcode = D.RcodeNameError
+	}
+	msg.Ns = z.records[:1]
+	return msg
+}
+
+// testServer is an authoritative server of the recursive tests.
+type testServer struct {
+	zones []*authZone
+	// swapCase answers with the letters of the question in the other case
+	swapCase bool
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (s *testServer) ServeDNS(w D.ResponseWriter, m *D.Msg) {
+	q := m.Question[0]
+	s.mu.Lock()
+	s.queries = append(s.queries, strings.ToLower(q.Name)+" "+D.TypeToString[q.Qtype])
+	s.mu.Unlock()
+
+	var zone *authZone
+	for _, z := range s.zones {
+		if D.IsSubDomain(z.name, q.Name) && (zone == nil || D.CountLabel(z.name) > D.CountLabel(zone.name)) {
+			zone = z
+		}
+	}
+	var msg *D.Msg
+	if zone == nil {
+		msg = new(D.Msg)
+		msg.SetRcode(m, D.RcodeRefused)
+	} else {
+		msg = zone.answer(m)
+	}
+	if s.swapCase {
+		b := []byte(msg.Question[0].Name)
+		for i, ch := range b {
+			if 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' {
+				b[i] ^= 0x20
+			}
+		}
+		msg.Question[0].Name = string(b)
+	}
+	_ = w.WriteMsg(msg)
+}
+
+func (s *testServer) asked() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// testDialer dials the loopback test servers in place of the addresses
+// of the name servers.
+type testDialer struct {
+	servers map[string]string
+	d       net.Dialer
+}
+
+func (d *testDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	server, ok := d.servers[host]
+	if !ok {
+		return nil, fmt.Errorf("no test server at %s", addr)
+	}
+	return d.d.DialContext(ctx, network, server)
+}
+
+// startTestServers serves the test servers on loopback, by the address
+// of the name server they stand for.
+func startTestServers(t *testing.T, servers map[string]*testServer) *testDialer {
+	t.Helper()
+	d := &testDialer{servers: make(map[string]string)}
+	for ip, s := range servers {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		started := make(chan struct{})
+		srv := &D.Server{PacketConn: pc, Handler: s, NotifyStartedFunc: func() { close(started) }}
+		go func() {
+			_ = srv.ActivateAndServe()
+		}()
+		<-started
+		t.Cleanup(func() {
+			_ = srv.Shutdown()
+		})
+		d.servers[ip] = pc.LocalAddr().String()
+	}
+	return d
+}
+
+// newTestRecursive returns the servers of the tests and a client using
+// them, with the root hints of a.root.test. at 192.0.2.1:
+//
+//	.                 192.0.2.1
+//	example.          192.0.2.2, NXDOMAIN for the empty non-terminals
+//	sub.example.      192.0.2.5, the glue in example.
+//	poison.example.   192.0.2.4 as ns.other., with off-bailiwick glue
+//	                  to the poisoned 203.0.113.99
+//	other.            192.0.2.3, adding a forged A of www.example. to
+//	                  the answers
+//	outzone.          192.0.2.4 as ns.other., without glue
+//	mixed.            192.0.2.6, swapping the case of the question
+func newTestRecursive(t *testing.T) (*recursiveClient, map[string]*testServer) {
+	t.Helper()
+	example := newAuthZone(t, "example.",
+		"www.example. 300 IN A 198.51.100.1",
+		"a.b.c.example. 300 IN A 198.51.100.2",
+		"sub.example. 300 IN NS ns.sub.example.",
+		"ns.sub.example. 300 IN A 192.0.2.5",
+		"poison.example. 300 IN NS ns.other.",
+	)
+	example.nxENT = true
+	example.extra = parseRRs(t, "ns.other. 300 IN A 203.0.113.99")
+	other := newAuthZone(t, "other.",
+		"ns.other. 300 IN A 192.0.2.4",
+		"www.other. 300 IN CNAME www.example.",
+	)
+	other.forged = parseRRs(t, "www.example. 300 IN A 203.0.113.66")
+
+	servers := map[string]*testServer{
+		"192.0.2.1": {zones: []*authZone{newAuthZone(t, ".",
+			"example. 300 IN NS ns1.example.",
+			"ns1.example. 300 IN A 192.0.2.2",
+			"other. 300 IN NS ns1.other.",
+			"ns1.other. 300 IN A 192.0.2.3",
+			"outzone. 300 IN NS ns.other.",
+			"mixed. 300 IN NS ns.mixed.",
+			"ns.mixed. 300 IN A 192.0.2.6",
+		)}},
+		"192.0.2.2": {zones: []*authZone{example}},
+		"192.0.2.3": {zones: []*authZone{other}},
+		"192.0.2.4": {zones: []*authZone{
+			newAuthZone(t, "outzone.", "host.outzone. 300 IN A 198.51.100.4"),
+			newAuthZone(t, "poison.example.", "host.poison.example. 300 IN A 198.51.100.5"),
+		}},
+		"192.0.2.5": {zones: []*authZone{newAuthZone(t, "sub.example.", "www.sub.example. 300 IN A 198.51.100.3")}},
+		"192.0.2.6": {
+			zones:    []*authZone{newAuthZone(t, "mixed.", "www.mixed. 300 IN A 198.51.100.6")},
+			swapCase: true,
+		},
+		"203.0.113.99": {zones: []*authZone{newAuthZone(t, "poison.example.", "host.poison.example. 300 IN A 203.0.113.66")}},
+	}
+	dialer := startTestServers(t, servers)
+
+	hints := filepath.Join(t.TempDir(), "named.root")
+	if err := os.WriteFile(hints, []byte(". 3600000 NS a.root.test.\na.root.test. 3600000 A 192.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newRecursiveClient("recursive://"+hints, &ClientOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.dialer = dialer
+	return c, servers
+}
+
+func TestRecursiveClient(t *testing.T) {
+	tests := []struct {
+		name  string
+		qname string
+		// answer are the records of the answer, none for an error
+		answer []string
+		check  func(t *testing.T, c *recursiveClient, servers map[string]*testServer)
+	}{
+		{
+			name: "delegation", qname: "www.example.",
+			answer: []string{"www.example.\t300\tIN\tA\t198.51.100.1"},
+			check: func(t *testing.T, c *recursiveClient, _ map[string]*testServer) {
+				if _, _, ok := c.delegations.Get("example."); !ok {
+					t.Error("delegation of example. not cached")
+				}
+			},
+		},
+		{
+			name: "in-bailiwick glue", qname: "www.sub.example.",
+			answer: []string{"www.sub.example.\t300\tIN\tA\t198.51.100.3"},
+		},
+		{
+			name: "off-bailiwick glue", qname: "host.poison.example.",
+			answer: []string{"host.poison.example.\t300\tIN\tA\t198.51.100.5"},
+			check: func(t *testing.T, _ *recursiveClient, servers map[string]*testServer) {
+				if q := servers["203.0.113.99"].asked(); len(q) > 0 {
+					t.Errorf("the glue of another bailiwick is used: %v", q)
+				}
+			},
+		},
+		{
+			name: "out-of-zone name server", qname: "host.outzone.",
+			answer: []string{"host.outzone.\t300\tIN\tA\t198.51.100.4"},
+			check: func(t *testing.T, _ *recursiveClient, servers map[string]*testServer) {
+				if q := servers["192.0.2.3"].asked(); !contains(q, "ns.other. A") {
+					t.Errorf("ns.other. not resolved: %v", q)
+				}
+			},
+		},
+		{
+			name: "minimisation fallback", qname: "a.b.c.example.",
+			answer: []string{"a.b.c.example.\t300\tIN\tA\t198.51.100.2"},
+			check: func(t *testing.T, _ *recursiveClient, servers map[string]*testServer) {
+				q := servers["192.0.2.2"].asked()
+				if !contains(q, "c.example. A") || !contains(q, "a.b.c.example. A") {
+					t.Errorf("no minimised query and fallback: %v", q)
+				}
+			},
+		},
+		{name: "0x20 mismatch", qname: "www.mixed."},
+		{
+			name: "cname across zones", qname: "www.other.",
+			answer: []string{
+				"www.other.\t300\tIN\tCNAME\twww.example.",
+				"www.example.\t300\tIN\tA\t198.51.100.1",
+			},
+			check: func(t *testing.T, _ *recursiveClient, servers map[string]*testServer) {
+				if q := servers["192.0.2.2"].asked(); !contains(q, "www.example. A") {
+					t.Errorf("www.example. not resolved from its zone: %v", q)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, servers := newTestRecursive(t)
+			m := new(D.Msg)
+			m.SetQuestion(tt.qname, D.TypeA)
+			msg, _, err := c.Exchange(m)
+			if len(tt.answer) == 0 {
+				if err == nil {
+					t.Fatalf("got %v, want an error", msg.Answer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var answer []string
+			for _, rr := range msg.Answer {
+				answer = append(answer, rr.String())
+			}
+			if strings.Join(answer, "\n") != strings.Join(tt.answer, "\n") {
+				t.Errorf("got answer %q, want %q", answer, tt.answer)
+			}
+			if tt.check != nil {
+				tt.check(t, c, servers)
+			}
+		})
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 
 	"github.com/libp2p/go-reuseport"
 	jsonDNS "github.com/m13253/dns-over-https/json-dns"
 	D "github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
 )
 
 type remote struct {
@@ -44,6 +46,8 @@ type Handler interface {
 type generalHandler struct {
 	h Handler
 	D.Handler
+	// cookies checks the DNS cookies of the queries over udp
+	cookies *cookieServer
 }
 
 type httpHandler struct {
@@ -55,13 +59,50 @@ func (h generalHandler) ServeDNS(w D.ResponseWriter, r *D.Msg) {
 	ww := new(generalResponseWriter)
 	ww.ResponseWriter = w
 
+	var rw ResponseWriter = ww
+	if h.cookies != nil {
+		var ip net.IP
+		if addr, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			ip = addr.IP
+		}
+
+		status, cookie := h.cookies.check(r, ip)
+		switch status {
+		case cookieMalformed:
+			m := new(D.Msg)
+			m.SetRcode(r, D.RcodeFormatError)
+			if err := w.WriteMsg(m); err != nil {
+				log.Println(err.Error())
+			}
+			return
+		case cookieBad:
+			// the client retries with the new cookie (RFC 7873 section 5.2.3)
+			m := new(D.Msg)
+			m.SetRcode(r, D.RcodeBadCookie)
+			m.SetEdns0(D.DefaultMsgSize, false)
+			setCookie(m, cookie)
+			if err := w.WriteMsg(m); err != nil {
+				log.Println(err.Error())
+			}
+			return
+		}
+
+		if cookie != nil {
+			size := D.MinMsgSize
+			if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+				size = int(opt.UDPSize())
+			}
+			rw = &cookieResponseWriter{generalResponseWriter: ww, cookie: cookie, size: size}
+		}
+	}
+
 	q := &Query{
 		Msg: r,
 		Remote: &remote{
 			Addr: w.RemoteAddr().String(),
 		},
 	}
-	h.h.ServeDNS(ww, q)
+	h.h.ServeDNS(rw, q)
 }
 
 func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -170,6 +211,11 @@ func ListenAndServe(addr, network string, handler Handler) error {
 
 	h := new(generalHandler)
 	h.h = handler
+	// the cookies make spoofing the source address harder, which
+	// doesn't work over tcp anyway
+	if network == "udp" {
+		h.cookies = newCookieServer()
+	}
 	srv.Handler = h
 
 	go func() {
@@ -216,7 +262,9 @@ func ListenAndServeTLS(addr, certFile, keyFile string, handler Handler) error {
 	return nil
 }
 
-func newHTTPServer(pattern string, handler Handler) *http.Server {
+// newHTTPServer returns a DoH server, which advertises the
+// HTTP/3 endpoint with the Alt-Svc header if altSvc isn't empty.
+func newHTTPServer(pattern, altSvc string, handler Handler) *http.Server {
 	var srv = new(http.Server)
 
 	h := new(httpHandler)
@@ -229,6 +277,13 @@ func newHTTPServer(pattern string, handler Handler) *http.Server {
 	router.Handle(pattern, h)
 	srv.Handler = router
 
+	if altSvc != "" {
+		srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Alt-Svc", altSvc)
+			router.ServeHTTP(w, r)
+		})
+	}
+
 	return srv
 }
 
@@ -240,18 +295,21 @@ func ListenHTTPAndServe(addr, pattern string, handler Handler) error {
 	}
 
 	go func() {
-		log.Println(newHTTPServer(pattern, handler).Serve(lsn))
+		log.Println(newHTTPServer(pattern, "", handler).Serve(lsn))
 	}()
 
 	return nil
 }
 
-func ListenHTTPAndServeTLS(addr, pattern, certFile, keyFile string, handler Handler) error {
+// ListenHTTPAndServeTLS serves DoH over HTTP/2 and HTTP/1.1, altSvc is
+// the value of the Alt-Svc header, e.g. `h3=":443"`, or empty for none.
+func ListenHTTPAndServeTLS(addr, pattern, certFile, keyFile, altSvc string, handler Handler) error {
 
 	tlsConfig, err := loadCertFile(certFile, keyFile)
 	if err != nil {
 		return err
 	}
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
 
 	lsn, err := reuseport.Listen("tcp", addr)
 	if err != nil {
@@ -261,7 +319,32 @@ func ListenHTTPAndServeTLS(addr, pattern, certFile, keyFile string, handler Hand
 	lsn = tls.NewListener(lsn, tlsConfig)
 
 	go func() {
-		log.Println(newHTTPServer(pattern, handler).Serve(lsn))
+		log.Println(newHTTPServer(pattern, altSvc, handler).Serve(lsn))
+	}()
+
+	return nil
+}
+
+// ListenHTTP3AndServe serves DoH over HTTP/3.
+func ListenHTTP3AndServe(addr, pattern, certFile, keyFile string, handler Handler) error {
+
+	tlsConfig, err := loadCertFile(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	pkt, err := reuseport.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http3.Server{
+		Handler:   newHTTPServer(pattern, "", handler).Handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+
+	go func() {
+		log.Println(srv.Serve(pkt))
 	}()
 
 	return nil
@@ -0,0 +1,138 @@
+package dns
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jsonDNS "github.com/m13253/dns-over-https/json-dns"
+	D "github.com/miekg/dns"
+)
+
+// answerHandler answers the A queries with 192.0.2.1, and keeps the
+// address of the last client.
+type answerHandler struct {
+	remote chan string
+}
+
+func (h answerHandler) ServeDNS(w ResponseWriter, q *Query) {
+	select {
+	case h.remote <- q.Remote.Addr:
+	default:
+	}
+	m := new(D.Msg)
+	m.SetReply(q.Msg)
+	rr, _ := D.NewRR(q.Msg.Question[0].Name + " 300 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+	_ = w.WriteMsg(m)
+}
+
+// freeUDPAddr returns a loopback address with a free UDP port.
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	_ = pc.Close()
+	return addr
+}
+
+func TestHTTP3Server(t *testing.T) {
+	ca := newTestCert(t, "test CA", true, nil)
+	leaf := newTestCert(t, "doh.test", false, ca)
+	certFile, keyFile := leaf.writeKeyPair(t)
+
+	addr := freeUDPAddr(t)
+	h := answerHandler{remote: make(chan string, 1)}
+	if err := ListenHTTP3AndServe(addr, "/q", certFile, keyFile, h); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := newHTTP3Client("h3://"+addr+"/q", &ClientOptions{
+		TLS: &TLSOptions{ServerName: "doh.test", CAFile: ca.writePEM(t)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("wire format", func(t *testing.T) {
+		m := new(D.Msg)
+		m.SetQuestion("example.org.", D.TypeA)
+		msg, _, err := c.Exchange(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Answer) != 1 || msg.Answer[0].(*D.A).A.String() != "192.0.2.1" {
+			t.Errorf("unexpected answer %v", msg.Answer)
+		}
+		if host, _, _ := net.SplitHostPort(<-h.remote); host != "127.0.0.1" {
+			t.Errorf("client address %s, want the loopback", host)
+		}
+	})
+
+	get := func(t *testing.T, url, accept string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := c.transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+		return resp
+	}
+
+	t.Run("json", func(t *testing.T) {
+		resp := get(t, "https://"+addr+"/q?name=example.org&type=A", DOHJSONMIMETYPE)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != DOHJSONMIMETYPE {
+			t.Fatalf("status %d, content type %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		var reply jsonDNS.Response
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 1 || reply.Answer[0].Data != "192.0.2.1" {
+			t.Errorf("unexpected answer %+v", reply.Answer)
+		}
+	})
+
+	t.Run("no content type", func(t *testing.T) {
+		resp := get(t, "https://"+addr+"/q?name=example.org", "")
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("other path", func(t *testing.T) {
+		resp := get(t, "https://"+addr+"/dns-query?name=example.org", DOHJSONMIMETYPE)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("status %d, want %d", resp.StatusCode, http.StatusNotFound)
+		}
+	})
+}
+
+func TestHTTPServerAltSvc(t *testing.T) {
+	for _, altSvc := range []string{"", `h3=":443"; ma=86400`} {
+		srv := newHTTPServer("", altSvc, answerHandler{})
+		req := httptest.NewRequest(http.MethodGet, "/dns-query?name=example.org", nil)
+		req.Header.Set("Accept", DOHMSGMIMETYPE)
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("status %d, want %d", w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("Alt-Svc"); got != altSvc {
+			t.Errorf("Alt-Svc %q, want %q", got, altSvc)
+		}
+	}
+}
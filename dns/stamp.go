@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Protocols of DNS stamps (https://dnscrypt.info/stamps-specifications)
+const (
+	stampProtoPlain    = 0x00
+	stampProtoDNSCrypt = 0x01
+	stampProtoDoH      = 0x02
+	stampProtoDoT      = 0x03
+	stampProtoDoQ      = 0x04
+)
+
+// stamp is a decoded sdns:// DNS stamp.
+type stamp struct {
+	proto uint8
+	props uint64
+	// addr is the ip and port of the server, it may be empty for DoH,
+	// DoT and DoQ, in which case the hostname is resolved
+	addr string
+	// serverPk is the provider public key of a DNSCrypt server
+	serverPk []byte
+	// hashes are the SHA256 digests of the TBS certificates,
+	// one of which must be in the certificate chain of the server
+	hashes [][]byte
+	// providerName is the provider name of a DNSCrypt server, or
+	// the hostname with an optional port of a DoH, DoT or DoQ server
+	providerName string
+	path         string
+}
+
+var errInvalidStamp = errors.New("invalid DNS stamp")
+
+type stampReader struct {
+	buf []byte
+}
+
+// lp reads a length-prefixed field.
+func (r *stampReader) lp() ([]byte, error) {
+	if len(r.buf) < 1 {
+		return nil, errInvalidStamp
+	}
+	n := int(r.buf[0])
+	if len(r.buf) < 1+n {
+		return nil, errInvalidStamp
+	}
+	v := r.buf[1 : 1+n]
+	r.buf = r.buf[1+n:]
+	return v, nil
+}
+
+// vlp reads a variable length set of length-prefixed fields, the high
+// bit of the length is set for every field but the last one.
+func (r *stampReader) vlp() (vs [][]byte, err error) {
+	for {
+		if len(r.buf) < 1 {
+			return nil, errInvalidStamp
+		}
+		more := r.buf[0]&0x80 != 0
+		n := int(r.buf[0] & 0x7f)
+		if len(r.buf) < 1+n {
+			return nil, errInvalidStamp
+		}
+		if n > 0 {
+			vs = append(vs, r.buf[1:1+n])
+		}
+		r.buf = r.buf[1+n:]
+		if !more {
+			return vs, nil
+		}
+	}
+}
+
+// withDefaultPort adds the port to addr if there isn't one.
+func withDefaultPort(addr, port string) string {
+	if addr == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+func parseStamp(s string) (*stamp, error) {
+	if !strings.HasPrefix(s, "sdns://") {
+		return nil, errInvalidStamp
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, "sdns://"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidStamp, err)
+	}
+	if len(buf) < 1 {
+		return nil, errInvalidStamp
+	}
+
+	st := &stamp{proto: buf[0]}
+	r := &stampReader{buf: buf[1:]}
+
+	if len(r.buf) < 8 {
+		return nil, errInvalidStamp
+	}
+	st.props = binary.LittleEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+
+	addr, err := r.lp()
+	if err != nil {
+		return nil, err
+	}
+	st.addr = string(addr)
+
+	switch st.proto {
+	case stampProtoPlain:
+		st.addr = withDefaultPort(st.addr, "53")
+		return st, nil
+	case stampProtoDNSCrypt:
+		st.addr = withDefaultPort(st.addr, "443")
+		if st.serverPk, err = r.lp(); err != nil {
+			return nil, err
+		}
+		if len(st.serverPk) != 32 {
+			return nil, fmt.Errorf("%w: invalid public key length", errInvalidStamp)
+		}
+		providerName, err := r.lp()
+		if err != nil {
+			return nil, err
+		}
+		st.providerName = string(providerName)
+	case stampProtoDoH, stampProtoDoT, stampProtoDoQ:
+		if st.proto == stampProtoDoH {
+			st.addr = withDefaultPort(st.addr, "443")
+		} else {
+			st.addr = withDefaultPort(st.addr, "853")
+		}
+		if st.hashes, err = r.vlp(); err != nil {
+			return nil, err
+		}
+		providerName, err := r.lp()
+		if err != nil {
+			return nil, err
+		}
+		st.providerName = string(providerName)
+		if st.proto == stampProtoDoH {
+			path, err := r.lp()
+			if err != nil {
+				return nil, err
+			}
+			st.path = string(path)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported protocol 0x%02x", errInvalidStamp, st.proto)
+	}
+
+	if st.providerName == "" {
+		return nil, fmt.Errorf("%w: empty provider name", errInvalidStamp)
+	}
+	return st, nil
+}
+
+// verifyCertHashes returns a function for tls.Config.VerifyConnection,
+// which checks that one of the certificates in the chain of the server
+// matches the hashes of the stamp.
+func verifyCertHashes(hashes [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, cert := range chainCertificates(cs) {
+			h := sha256.Sum256(cert.RawTBSCertificate)
+			for _, hash := range hashes {
+				if string(h[:]) == string(hash) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("certificate pinning failed: no certificate of %s matches the hashes of the DNS stamp",
+			cs.ServerName)
+	}
+}
+
+// applyStampTLS sets the hostname and the certificate hashes of a stamp,
+// a server name of the options takes precedence over the hostname.
+func applyStampTLS(config *tls.Config, st *stamp, hostname string, opts *ClientOptions) {
+	if opts == nil || opts.TLS == nil || opts.TLS.ServerName == "" {
+		config.ServerName = hostname
+	}
+	if len(st.hashes) > 0 {
+		addVerifyConnection(config, verifyCertHashes(st.hashes))
+	}
+}
+
+// newStampClient returns the client for a sdns:// DNS stamp.
+func newStampClient(s string, opts *ClientOptions) (Client, error) {
+	st, err := parseStamp(s)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname := st.providerName
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+
+	switch st.proto {
+	case stampProtoPlain:
+		return newGeneralClient("udp://"+st.addr, opts)
+	case stampProtoDNSCrypt:
+		return newDNSCryptClient(st, opts)
+	case stampProtoDoH:
+		c, err := newHTTPClient("https://"+st.providerName+st.path, opts)
+		if err != nil {
+			return nil, err
+		}
+		// connect to the address of the stamp instead of resolving the hostname
+		c.addr = st.addr
+		applyStampTLS(c.transport.(*http.Transport).TLSClientConfig, st, hostname, opts)
+		return c, nil
+	case stampProtoDoT:
+		addr := st.addr
+		if addr == "" {
+			addr = withDefaultPort(st.providerName, "853")
+		}
+		c, err := newGeneralClient("tls://"+addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		applyStampTLS(c.TLSConfig, st, hostname, opts)
+		return c, nil
+	case stampProtoDoQ:
+		addr := st.addr
+		if addr == "" {
+			addr = withDefaultPort(st.providerName, "853")
+		}
+		c, err := newQUICClient("quic://"+addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		applyStampTLS(c.tlsConfig, st, hostname, opts)
+		return c, nil
+	}
+	return nil, errInvalidStamp
+}
@@ -0,0 +1,45 @@
+package dns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestVerifyCertHashes(t *testing.T) {
+	ca := newTestCert(t, "test CA", true, nil)
+	leaf := newTestCert(t, "doh.test", false, ca)
+	// a certificate of another server, which is public
+	pinned := newTestCert(t, "pinned.test", true, nil)
+
+	hash := func(c *testCert) []byte {
+		h := sha256.Sum256(c.cert.RawTBSCertificate)
+		return h[:]
+	}
+	tests := []struct {
+		name   string
+		hashes [][]byte
+		ok     bool
+	}{
+		{"leaf", [][]byte{hash(leaf)}, true},
+		{"CA", [][]byte{hash(ca)}, true},
+		{"extra certificate", [][]byte{hash(pinned)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := x509.NewCertPool()
+			pool.AddCert(ca.cert)
+			config := &tls.Config{ServerName: "doh.test", RootCAs: pool}
+			addVerifyConnection(config, verifyCertHashes(tt.hashes))
+
+			err := tlsHandshake(t, leaf.tlsCertificate(pinned), config)
+			if tt.ok && err != nil {
+				t.Errorf("handshake failed: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("handshake succeeded with the hash of an extra certificate")
+			}
+		})
+	}
+}
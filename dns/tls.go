@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TLSOptions are the TLS settings of an upstream.
+type TLSOptions struct {
+	// ServerName overrides the host of the url as the SNI and
+	// the name verified in the certificate
+	ServerName string
+	// CAFile is a PEM file of the CAs trusted instead of the system ones
+	CAFile string
+	// CertFile and KeyFile are the client certificate for mutual TLS
+	CertFile string
+	KeyFile  string
+	// SPKIPins are the base64 SHA256 digests of the subject public keys,
+	// one of which must be in the verified certificate chain of the server
+	SPKIPins []string
+}
+
+// newTLSConfig returns the tls.Config of an upstream named serverName.
+func newTLSConfig(serverName string, opts *ClientOptions) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if opts == nil || opts.TLS == nil {
+		return config, nil
+	}
+	o := opts.TLS
+
+	if o.ServerName != "" {
+		config.ServerName = o.ServerName
+	}
+
+	if o.CAFile != "" {
+		buf, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificate found in %s", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(o.SPKIPins) > 0 {
+		var pins [][]byte
+		for _, s := range o.SPKIPins {
+			pin, err := base64.StdEncoding.DecodeString(s)
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin %q", s)
+			}
+			pins = append(pins, pin)
+		}
+		addVerifyConnection(config, verifySPKIPins(pins))
+	}
+
+	return config, nil
+}
+
+// verifySPKIPins returns a function for tls.Config.VerifyConnection,
+// which checks that one of the certificates in the chain of the server
+// has a pinned public key.
+func verifySPKIPins(pins [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		var got []string
+		for _, cert := range chainCertificates(cs) {
+			h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if string(h[:]) == string(pin) {
+					return nil
+				}
+			}
+			got = append(got, base64.StdEncoding.EncodeToString(h[:]))
+		}
+		return fmt.Errorf("certificate pinning failed: no SPKI pin matches the certificates of %s, whose SPKI hashes are %s",
+			cs.ServerName, strings.Join(got, ", "))
+	}
+}
+
+// chainCertificates returns the certificates of the verified chains of
+// the server, or only its leaf if the chains aren't verified. The other
+// certificates sent by the server prove nothing, since anyone can send
+// a public certificate without holding its key.
+func chainCertificates(cs tls.ConnectionState) (certs []*x509.Certificate) {
+	if len(cs.VerifiedChains) == 0 {
+		if len(cs.PeerCertificates) > 0 {
+			certs = append(certs, cs.PeerCertificates[0])
+		}
+		return
+	}
+	seen := make(map[*x509.Certificate]bool)
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if !seen[cert] {
+				seen[cert] = true
+				certs = append(certs, cert)
+			}
+		}
+	}
+	return
+}
+
+// addVerifyConnection adds verify to the checks of config.VerifyConnection.
+func addVerifyConnection(config *tls.Config, verify func(tls.ConnectionState) error) {
+	prev := config.VerifyConnection
+	if prev == nil {
+		config.VerifyConnection = verify
+		return
+	}
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := prev(cs); err != nil {
+			return err
+		}
+		return verify(cs)
+	}
+}
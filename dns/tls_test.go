@@ -0,0 +1,49 @@
+package dns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestVerifySPKIPins(t *testing.T) {
+	ca := newTestCert(t, "test CA", true, nil)
+	leaf := newTestCert(t, "dot.test", false, ca)
+	// a certificate of another server, which is public
+	pinned := newTestCert(t, "pinned.test", true, nil)
+
+	pin := func(c *testCert) []byte {
+		h := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+		return h[:]
+	}
+	tests := []struct {
+		name     string
+		pins     [][]byte
+		insecure bool
+		ok       bool
+	}{
+		{"leaf", [][]byte{pin(leaf)}, false, true},
+		{"CA", [][]byte{pin(ca)}, false, true},
+		{"extra certificate", [][]byte{pin(pinned)}, false, false},
+		{"unverified leaf", [][]byte{pin(leaf)}, true, true},
+		{"unverified extra certificate", [][]byte{pin(pinned)}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := x509.NewCertPool()
+			pool.AddCert(ca.cert)
+			config := &tls.Config{ServerName: "dot.test", RootCAs: pool, InsecureSkipVerify: tt.insecure}
+			addVerifyConnection(config, verifySPKIPins(tt.pins))
+
+			// the server sends the pinned certificate after its own chain
+			err := tlsHandshake(t, leaf.tlsCertificate(pinned), config)
+			if tt.ok && err != nil {
+				t.Errorf("handshake failed: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("handshake succeeded with the pin of an extra certificate")
+			}
+		})
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/zekexy/leedns
 
-go 1.15
+go 1.24
 
 require (
 	github.com/fsnotify/fsnotify v1.4.9
@@ -8,9 +8,17 @@ require (
 	github.com/libp2p/go-reuseport v0.0.2
 	github.com/m13253/dns-over-https v1.4.2
 	github.com/miekg/dns v1.1.43
+	github.com/quic-go/quic-go v0.59.1
 	github.com/robfig/cron/v3 v3.0.1
 	github.com/spf13/pflag v1.0.5
-	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985 // indirect
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	golang.org/x/crypto v0.41.0
 	gopkg.in/yaml.v2 v2.4.0
 )
+
+require (
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+)
@@ -0,0 +1,59 @@
+package listener
+
+import (
+	D "github.com/miekg/dns"
+)
+
+// maxUDPSize is the largest UDP payload the listeners send and advertise.
+const maxUDPSize = 4096
+
+// setReplyEDNS replaces the OPT record of the response m with the one for
+// the client of the query q. The options of the upstream which are only
+// meaningful between two hops, like cookies and padding, are dropped, and
+// there is no OPT record unless the client has sent one (RFC 6891 section 7).
+func setReplyEDNS(m, q *D.Msg) {
+	respOpt := m.IsEdns0()
+
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != D.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+
+	reqOpt := q.IsEdns0()
+	if reqOpt == nil {
+		// the extended rcodes need the OPT record
+		if m.Rcode > 0xF {
+			m.Rcode = D.RcodeServerFailure
+		}
+		return
+	}
+
+	opt := &D.OPT{Hdr: D.RR_Header{Name: ".", Rrtype: D.TypeOPT}}
+	opt.SetUDPSize(maxUDPSize)
+	opt.SetDo(reqOpt.Do())
+	if respOpt != nil {
+		for _, o := range respOpt.Option {
+			switch o.(type) {
+			case *D.EDNS0_COOKIE, *D.EDNS0_PADDING, *D.EDNS0_TCP_KEEPALIVE:
+			default:
+				opt.Option = append(opt.Option, o)
+			}
+		}
+	}
+	m.Extra = append(m.Extra, opt)
+}
+
+// udpSize returns the largest response the client of q accepts over UDP.
+func udpSize(q *D.Msg) int {
+	size := D.MinMsgSize
+	if opt := q.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > maxUDPSize {
+		size = maxUDPSize
+	}
+	return size
+}
@@ -0,0 +1,151 @@
+package listener
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zekexy/leedns/dns"
+	D "github.com/miekg/dns"
+)
+
+func TestSetReplyEDNS(t *testing.T) {
+	newResponse := func(rcode int) *D.Msg {
+		m := new(D.Msg)
+		m.SetQuestion("example.org.", D.TypeA)
+		m.Response = true
+		m.Rcode = rcode
+		m.SetEdns0(1232, true)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option,
+			&D.EDNS0_COOKIE{Code: D.EDNS0COOKIE, Cookie: "0102030405060708"},
+			&D.EDNS0_PADDING{Padding: make([]byte, 8)},
+			&D.EDNS0_TCP_KEEPALIVE{Code: D.EDNS0TCPKEEPALIVE},
+			&D.EDNS0_EDE{InfoCode: D.ExtendedErrorCodeStaleAnswer},
+		)
+		return m
+	}
+
+	tests := []struct {
+		name  string
+		rcode int
+		// edns is whether the query has an OPT record, and do its DO bit
+		edns, do bool
+		want     int
+	}{
+		{name: "no edns", rcode: D.RcodeSuccess, want: D.RcodeSuccess},
+		{name: "no edns extended rcode", rcode: D.RcodeBadCookie, want: D.RcodeServerFailure},
+		{name: "edns", rcode: D.RcodeSuccess, edns: true, want: D.RcodeSuccess},
+		{name: "edns do", rcode: D.RcodeSuccess, edns: true, do: true, want: D.RcodeSuccess},
+		{name: "edns extended rcode", rcode: D.RcodeBadCookie, edns: true, want: D.RcodeBadCookie},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(D.Msg)
+			q.SetQuestion("example.org.", D.TypeA)
+			if tt.edns {
+				q.SetEdns0(512, tt.do)
+			}
+			m := newResponse(tt.rcode)
+			setReplyEDNS(m, q)
+
+			if m.Rcode != tt.want {
+				t.Errorf("rcode %s, want %s", D.RcodeToString[m.Rcode], D.RcodeToString[tt.want])
+			}
+			opt := m.IsEdns0()
+			if !tt.edns {
+				if opt != nil {
+					t.Error("OPT record sent to a client without EDNS")
+				}
+				return
+			}
+			if opt == nil {
+				t.Fatal("no OPT record")
+			}
+			if opt.UDPSize() != maxUDPSize || opt.Do() != tt.do {
+				t.Errorf("UDP size %d DO %t, want %d %t", opt.UDPSize(), opt.Do(), maxUDPSize, tt.do)
+			}
+			// only the end-to-end options are kept
+			if len(opt.Option) != 1 || opt.Option[0].Option() != D.EDNS0EDE {
+				t.Errorf("options %v, want the EDE only", opt.Option)
+			}
+		})
+	}
+}
+
+func TestUDPSize(t *testing.T) {
+	tests := []struct {
+		size uint16
+		edns bool
+		want int
+	}{
+		{want: D.MinMsgSize},
+		{size: 100, edns: true, want: D.MinMsgSize},
+		{size: 1232, edns: true, want: 1232},
+		{size: 65535, edns: true, want: maxUDPSize},
+	}
+	for _, tt := range tests {
+		q := new(D.Msg)
+		q.SetQuestion("example.org.", D.TypeA)
+		if tt.edns {
+			q.SetEdns0(tt.size, false)
+		}
+		if got := udpSize(q); got != tt.want {
+			t.Errorf("size %d: got %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+// recordWriter keeps the message written.
+type recordWriter struct {
+	msg *D.Msg
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *recordWriter) WriteMsg(m *D.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestReplyTruncate(t *testing.T) {
+	tests := []struct {
+		serviceType string
+		size        uint16
+		truncated   bool
+	}{
+		{serviceType: "udp", truncated: true},
+		{serviceType: "udp", size: 1232, truncated: true},
+		{serviceType: "udp", size: 4096},
+		{serviceType: "tcp"},
+	}
+	for _, tt := range tests {
+		q := new(D.Msg)
+		q.SetQuestion("example.org.", D.TypeTXT)
+		if tt.size > 0 {
+			q.SetEdns0(tt.size, false)
+		}
+		m := new(D.Msg)
+		m.SetReply(q)
+		for i := 0; i < 40; i++ {
+			rr, _ := D.NewRR(fmt.Sprintf(`example.org. 300 IN TXT "record %d of a long answer to overflow the size"`, i))
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w := new(recordWriter)
+		h := handler{l: &Listener{ServiceType: tt.serviceType}}
+		h.reply(w, &dns.Query{Msg: q}, m)
+
+		limit := int(tt.size)
+		if limit < D.MinMsgSize {
+			limit = D.MinMsgSize
+		}
+		if w.msg.Truncated != tt.truncated {
+			t.Errorf("%s size %d: truncated %t, want %t", tt.serviceType, tt.size, w.msg.Truncated, tt.truncated)
+		}
+		if tt.truncated && w.msg.Len() > limit {
+			t.Errorf("%s size %d: %d octets sent", tt.serviceType, tt.size, w.msg.Len())
+		}
+	}
+}
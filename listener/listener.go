@@ -3,9 +3,11 @@ package listener
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/zekexy/leedns/dns"
 	R "github.com/zekexy/leedns/resolver"
@@ -18,6 +20,35 @@ type Listener struct {
 	CertFile    string
 	KeyFile     string
 	HttpPath    string
+	IdleTimeout time.Duration
+	MaxStreams  int64
+	// PaddingBlock pads the responses of encrypted listeners to a
+	// multiple of it, 0 for no padding
+	PaddingBlock int
+	// FailureRcode is the rcode when no answer is found, "servfail" if
+	// empty, "refused" or "noerror" for the clients mishandling SERVFAIL
+	FailureRcode string
+}
+
+// failureRcodes are the valid values of Listener.FailureRcode.
+var failureRcodes = map[string]int{
+	"":         D.RcodeServerFailure,
+	"servfail": D.RcodeServerFailure,
+	"refused":  D.RcodeRefused,
+	"noerror":  D.RcodeSuccess,
+}
+
+func (l *Listener) failureRcode() int {
+	return failureRcodes[l.FailureRcode]
+}
+
+// encrypted reports whether the listener serves over an encrypted transport.
+func (l *Listener) encrypted() bool {
+	switch l.ServiceType {
+	case "tls", "tcp-tls", "https", "https3", "quic":
+		return true
+	}
+	return false
 }
 
 type handler struct {
@@ -34,30 +65,90 @@ func (h handler) ServeDNS(w dns.ResponseWriter, q *dns.Query) {
 		log.Printf("%s at %s: %s from %s", h.l.ServiceType, h.l.Addr, qStr, q.Remote.Addr)
 	}
 
-	m, err := h.r.Exchange(q.Msg)
+	switch {
+	case q.Msg.Opcode != D.OpcodeQuery:
+		log.Printf("%s at %s: opcode %s from %s not implemented", h.l.ServiceType, h.l.Addr,
+			D.OpcodeToString[q.Msg.Opcode], q.Remote.Addr)
+		h.reply(w, q, new(D.Msg).SetRcode(q.Msg, D.RcodeNotImplemented))
+		return
+	case len(q.Msg.Question) != 1:
+		// a query has exactly one question (RFC 9619)
+		log.Printf("%s at %s: %d questions from %s", h.l.ServiceType, h.l.Addr, len(q.Msg.Question), q.Remote.Addr)
+		h.reply(w, q, new(D.Msg).SetRcode(q.Msg, D.RcodeFormatError))
+		return
+	}
+
+	m, err := h.r.ExchangeFrom(q.Msg, q.Remote.Addr)
 	if err != nil {
 		log.Println(err.Error())
 	}
 	if m == nil {
 		log.Printf("%s: No result from upstreams and hosts file", qStr)
 		m = new(D.Msg)
+		m.Rcode = h.l.failureRcode()
+		m.SetEdns0(maxUDPSize, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, R.EDE(err))
+	}
+	// the extended errors of leedns and the upstreams
+	for _, ede := range R.GetEDE(m) {
+		log.Printf("%s: %s, EDE %s", qStr, D.RcodeToString[m.Rcode], ede.String())
 	}
 
+	// SetReply resets the rcode, keep the one from the answer
+	rcode := m.Rcode
 	m.SetReply(q.Msg)
+	m.Rcode = rcode
+	h.reply(w, q, m)
+}
+
+// reply writes the response m to the query q.
+func (h handler) reply(w dns.ResponseWriter, q *dns.Query, m *D.Msg) {
+	setReplyEDNS(m, q.Msg)
 
-	err = w.WriteMsg(m)
+	// pad only for the clients supporting EDNS(0) (RFC 7830 section 4)
+	if h.l.PaddingBlock > 0 && h.l.encrypted() {
+		dns.Pad(m, h.l.PaddingBlock)
+	}
+
+	// the client retries over TCP on a truncated response
+	if h.l.ServiceType == "udp" {
+		m.Truncate(udpSize(q.Msg))
+	}
+
+	err := w.WriteMsg(m)
 	if err != nil {
 		log.Println(err.Error())
 	}
 }
 
+// altSvc returns the Alt-Svc header advertising the first https3 listener.
+func altSvc(listener []*Listener) string {
+	for _, l := range listener {
+		if l.ServiceType != "https3" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(l.Addr)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf(`h3=":%s"; ma=86400`, port)
+	}
+	return ""
+}
+
 func Start(listener []*Listener, resolver *R.Resolver) {
 
+	alt := altSvc(listener)
 	for _, l := range listener {
 		h := new(handler)
 		h.r = resolver
 		h.l = l
 		var err error
+		if _, ok := failureRcodes[l.FailureRcode]; !ok {
+			log.Printf("Start %v DNS Server Error at %v: invalid failure-rcode %s\n", l.ServiceType, l.Addr, l.FailureRcode)
+			continue
+		}
 		switch l.ServiceType {
 		case "udp", "tcp":
 			err = dns.ListenAndServe(l.Addr, l.ServiceType, h)
@@ -66,7 +157,11 @@ func Start(listener []*Listener, resolver *R.Resolver) {
 		case "http":
 			err = dns.ListenHTTPAndServe(l.Addr, l.HttpPath, h)
 		case "https":
-			err = dns.ListenHTTPAndServeTLS(l.Addr, l.HttpPath, l.CertFile, l.KeyFile, h)
+			err = dns.ListenHTTPAndServeTLS(l.Addr, l.HttpPath, l.CertFile, l.KeyFile, alt, h)
+		case "https3":
+			err = dns.ListenHTTP3AndServe(l.Addr, l.HttpPath, l.CertFile, l.KeyFile, h)
+		case "quic":
+			err = dns.ListenQUICAndServe(l.Addr, l.CertFile, l.KeyFile, l.IdleTimeout, l.MaxStreams, h)
 		default:
 			err = fmt.Errorf("error network type: %s", l.ServiceType)
 		}
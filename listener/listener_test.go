@@ -0,0 +1,175 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/zekexy/leedns/dns"
+	R "github.com/zekexy/leedns/resolver"
+	D "github.com/miekg/dns"
+)
+
+func TestAltSvc(t *testing.T) {
+	tests := []struct {
+		listener []*Listener
+		want     string
+	}{
+		{[]*Listener{{ServiceType: "https", Addr: ":443"}}, ""},
+		{[]*Listener{
+			{ServiceType: "https", Addr: ":443"},
+			{ServiceType: "https3", Addr: "0.0.0.0:8443"},
+			{ServiceType: "https3", Addr: ":9443"},
+		}, `h3=":8443"; ma=86400`},
+	}
+	for _, tt := range tests {
+		if got := altSvc(tt.listener); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// serveListener serves r with a tcp listener of failureRcode on a
+// loopback port, and returns its address.
+func serveListener(t *testing.T, r *R.Resolver, failureRcode string) string {
+	t.Helper()
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lsn.Addr().String()
+	_ = lsn.Close()
+
+	l := &Listener{ServiceType: "tcp", Addr: addr, FailureRcode: failureRcode}
+	if err := dns.ListenAndServe(addr, "tcp", handler{r: r, l: l}); err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// upstreamFailing returns a strategy failing the queries with err.
+func upstreamFailing(err error) func(*D.Msg, *R.Resolver) (*D.Msg, error) {
+	return func(*D.Msg, *R.Resolver) (*D.Msg, error) {
+		return nil, err
+	}
+}
+
+func TestListenerEDE(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Net: "udp", Err: context.DeadlineExceeded}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name     string
+		qname    string
+		strategy func(*D.Msg, *R.Resolver) (*D.Msg, error)
+		edns     bool
+		rcode    int
+		// code is the EDE expected, none if 0
+		code uint16
+	}{
+		{name: "no upstream", strategy: upstreamFailing(nil), edns: true,
+			rcode: D.RcodeServerFailure, code: D.ExtendedErrorCodeNoReachableAuthority},
+		{name: "timeout", strategy: upstreamFailing(timeout), edns: true,
+			rcode: D.RcodeServerFailure, code: D.ExtendedErrorCodeNoReachableAuthority},
+		{name: "refused", strategy: upstreamFailing(refused), edns: true,
+			rcode: D.RcodeServerFailure, code: D.ExtendedErrorCodeNoReachableAuthority},
+		{name: "network error", strategy: upstreamFailing(errors.New("x509: certificate signed by unknown authority")), edns: true,
+			rcode: D.RcodeServerFailure, code: D.ExtendedErrorCodeNetworkError},
+		{name: "without edns", strategy: upstreamFailing(nil), rcode: D.RcodeServerFailure},
+		{name: "blocked", qname: "ads.example.org.", edns: true, code: D.ExtendedErrorCodeBlocked},
+	}
+
+	hosts := R.Hosts{}
+	blocked := new(D.Msg)
+	blocked.SetQuestion("ads.example.org.", D.TypeA)
+	rr, _ := D.NewRR("ads.example.org. 86400 IN A 0.0.0.0")
+	blocked.Answer = append(blocked.Answer, rr)
+	blocked.SetEdns0(4096, false)
+	blocked.IsEdns0().Option = append(blocked.IsEdns0().Option, &D.EDNS0_EDE{InfoCode: D.ExtendedErrorCodeBlocked})
+	hosts[blocked.Question[0].String()] = blocked
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &R.Resolver{StrategyFun: tt.strategy, Hosts: hosts}
+			addr := serveListener(t, r, "")
+
+			m := new(D.Msg)
+			qname := tt.qname
+			if qname == "" {
+				qname = "www.example.org."
+			}
+			m.SetQuestion(qname, D.TypeA)
+			if tt.edns {
+				m.SetEdns0(4096, false)
+			}
+			msg, _, err := (&D.Client{Net: "tcp"}).Exchange(m, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", D.RcodeToString[msg.Rcode], D.RcodeToString[tt.rcode])
+			}
+			var codes []uint16
+			for _, ede := range R.GetEDE(msg) {
+				codes = append(codes, ede.InfoCode)
+			}
+			switch {
+			case tt.code == 0 && len(codes) > 0:
+				t.Errorf("EDE %v, want none", codes)
+			case tt.code != 0 && (len(codes) != 1 || codes[0] != tt.code):
+				t.Errorf("EDE %v, want %d", codes, tt.code)
+			}
+		})
+	}
+}
+
+func TestListenerRcode(t *testing.T) {
+	answer := func(m *D.Msg, _ *R.Resolver) (*D.Msg, error) {
+		msg := new(D.Msg)
+		msg.SetReply(m)
+		msg.Rcode = D.RcodeNameError
+		return msg, nil
+	}
+
+	tests := []struct {
+		name         string
+		failureRcode string
+		strategy     func(*D.Msg, *R.Resolver) (*D.Msg, error)
+		opcode       int
+		questions    int
+		rcode        int
+	}{
+		{name: "answer", strategy: answer, questions: 1, rcode: D.RcodeNameError},
+		{name: "failure", strategy: upstreamFailing(nil), questions: 1, rcode: D.RcodeServerFailure},
+		{name: "failure servfail", failureRcode: "servfail", strategy: upstreamFailing(nil), questions: 1, rcode: D.RcodeServerFailure},
+		{name: "failure refused", failureRcode: "refused", strategy: upstreamFailing(nil), questions: 1, rcode: D.RcodeRefused},
+		{name: "failure noerror", failureRcode: "noerror", strategy: upstreamFailing(nil), questions: 1, rcode: D.RcodeSuccess},
+		{name: "notify", strategy: answer, opcode: D.OpcodeNotify, questions: 1, rcode: D.RcodeNotImplemented},
+		{name: "no question", strategy: answer, rcode: D.RcodeFormatError},
+		{name: "two questions", strategy: answer, questions: 2, rcode: D.RcodeFormatError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serveListener(t, &R.Resolver{StrategyFun: tt.strategy}, tt.failureRcode)
+
+			m := new(D.Msg)
+			m.Id = D.Id()
+			m.RecursionDesired = true
+			m.Opcode = tt.opcode
+			for i := 0; i < tt.questions; i++ {
+				m.Question = append(m.Question, D.Question{Name: "www.example.org.", Qtype: D.TypeA, Qclass: D.ClassINET})
+			}
+			msg, _, err := (&D.Client{Net: "tcp"}).Exchange(m, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", D.RcodeToString[msg.Rcode], D.RcodeToString[tt.rcode])
+			}
+			if msg.Id != m.Id || !msg.Response {
+				t.Error("not a response to the query")
+			}
+		})
+	}
+}
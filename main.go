@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/zekexy/leedns/dns"
 	"github.com/zekexy/leedns/listener"
@@ -14,57 +17,244 @@ import (
 )
 
 type Listener struct {
-	ServiceType string `yaml:"type"`
-	Addr        string `yaml:"addr"`
-	CertFile    string `yaml:"certfile"`
-	KeyFile     string `yaml:"keyfile"`
-	HttpPath    string `yaml:"http-path"`
+	ServiceType  string        `yaml:"type"`
+	Addr         string        `yaml:"addr"`
+	CertFile     string        `yaml:"certfile"`
+	KeyFile      string        `yaml:"keyfile"`
+	HttpPath     string        `yaml:"http-path"`
+	IdleTimeout  time.Duration `yaml:"idle-timeout"`
+	MaxStreams   int64         `yaml:"max-streams"`
+	FailureRcode string        `yaml:"failure-rcode"`
 }
 
 type Upstream struct {
-	URL    string `yaml:"url"`
-	Weight int    `yaml:"weight"`
+	URL             string       `yaml:"url"`
+	Weight          int          `yaml:"weight"`
+	Timeout         timeout      `yaml:"timeout"`
+	DisableTCPRetry bool         `yaml:"disable-tcp-retry"`
+	TLS             *UpstreamTLS `yaml:"tls"`
+	Proxy           string       `yaml:"proxy"`
+	Bind            string       `yaml:"bind"`
+	Mark            int          `yaml:"mark"`
+	Domains         []string     `yaml:"domains"`
+}
+
+// timeout is a duration like "5s" or "500ms", or a number of seconds.
+type timeout time.Duration
+
+func (t *timeout) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	d, err := time.ParseDuration(s)
+	if seconds, serr := strconv.ParseFloat(s, 64); serr == nil {
+		d, err = time.Duration(seconds*float64(time.Second)), nil
+	}
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid timeout %q, want a positive duration like 5s or 500ms", s)
+	}
+	*t = timeout(d)
+	return nil
+}
+
+// UnmarshalYAML accepts either the url of an upstream or its settings.
+func (u *Upstream) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*u = Upstream{URL: s}
+		return nil
+	}
+
+	type upstream Upstream
+	return unmarshal((*upstream)(u))
+}
+
+type UpstreamTLS struct {
+	ServerName string   `yaml:"server-name"`
+	CAFile     string   `yaml:"ca"`
+	CertFile   string   `yaml:"certfile"`
+	KeyFile    string   `yaml:"keyfile"`
+	SPKIPins   []string `yaml:"spki-pins"`
+}
+
+type Zone struct {
+	File   string `yaml:"file"`
+	Origin string `yaml:"origin"`
+}
+
+type Leases struct {
+	Domain  string   `yaml:"domain"`
+	Dnsmasq []string `yaml:"dnsmasq"`
+	Dhcpd   []string `yaml:"dhcpd"`
+}
+
+type ECS struct {
+	Mode       string `yaml:"mode"`
+	IPv4Prefix uint8  `yaml:"ipv4-prefix"`
+	IPv6Prefix uint8  `yaml:"ipv6-prefix"`
+	Subnet     string `yaml:"subnet"`
+}
+
+type DNSSEC struct {
+	Enable          bool     `yaml:"enable"`
+	TrustAnchors    []string `yaml:"trust-anchors"`
+	TrustAnchorFile string   `yaml:"trust-anchor-file"`
+}
+
+type DNS64 struct {
+	Enable         bool     `yaml:"enable"`
+	Prefix         string   `yaml:"prefix"`
+	Exclude        []string `yaml:"exclude"`
+	ExcludeDomains []string `yaml:"exclude-domains"`
+	Clients        []string `yaml:"clients"`
+}
+
+type AddressFamily struct {
+	Mode   string                `yaml:"mode"`
+	Groups []*AddressFamilyGroup `yaml:"groups"`
+}
+
+type AddressFamilyGroup struct {
+	Clients []string `yaml:"clients"`
+	Mode    string   `yaml:"mode"`
+}
+
+// Padding is the block sizes of EDNS(0) padding, the ones
+// recommended by RFC 8467 if unset, 0 for no padding.
+type Padding struct {
+	Query    *int `yaml:"query"`
+	Response *int `yaml:"response"`
+}
+
+func (p Padding) query() int {
+	if p.Query == nil {
+		return dns.DefaultQueryPaddingBlock
+	}
+	return *p.Query
+}
+
+func (p Padding) response() int {
+	if p.Response == nil {
+		return dns.DefaultResponsePaddingBlock
+	}
+	return *p.Response
+}
+
+type PrivateReverse struct {
+	Policy   string      `yaml:"policy"`
+	Upstream []*Upstream `yaml:"upstream"`
+}
+
+// stringList accepts either a single string or a list of strings.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		if s != "" {
+			*l = stringList{s}
+		}
+		return nil
+	}
+
+	var ss []string
+	if err := unmarshal(&ss); err != nil {
+		return err
+	}
+	*l = ss
+	return nil
 }
 
 type Config struct {
-	Listener   []*Listener `yaml:"listener"`
-	Upstream   []*Upstream `yaml:"upstream"`
-	BootStrap  []string    `yaml:"bootstrap"`
-	HostsFile  string      `yaml:"hosts"`
-	Cache      bool        `yaml:"cache"`
-	Strategy   string      `yaml:"strategy"`
-	MaxRetries int         `yaml:"max-retries"`
+	Listener       []*Listener    `yaml:"listener"`
+	Upstream       []*Upstream    `yaml:"upstream"`
+	BootStrap      []*Upstream    `yaml:"bootstrap"`
+	HostsFile      stringList     `yaml:"hosts"`
+	Leases         Leases         `yaml:"leases"`
+	Zones          []*Zone        `yaml:"zones"`
+	PrivateReverse PrivateReverse `yaml:"private-reverse"`
+	ECS            ECS            `yaml:"ecs"`
+	DNSSEC         DNSSEC         `yaml:"dnssec"`
+	DNS64          DNS64          `yaml:"dns64"`
+	AddressFamily  AddressFamily  `yaml:"address-family"`
+	Padding        Padding        `yaml:"padding"`
+	Cache          bool           `yaml:"cache"`
+	Strategy       string         `yaml:"strategy"`
+	MaxRetries     int            `yaml:"max-retries"`
 }
 
 var (
 	configFilePath string
 )
 
-func parseListener(ls []*Listener) (lis []*listener.Listener) {
+func parseListener(ls []*Listener, paddingBlock int) (lis []*listener.Listener) {
 	for _, l := range ls {
 		newListener := &listener.Listener{
-			ServiceType: l.ServiceType,
-			Addr:        l.Addr,
-			CertFile:    l.CertFile,
-			KeyFile:     l.KeyFile,
-			HttpPath:    l.HttpPath,
+			ServiceType:  l.ServiceType,
+			Addr:         l.Addr,
+			CertFile:     l.CertFile,
+			KeyFile:      l.KeyFile,
+			HttpPath:     l.HttpPath,
+			IdleTimeout:  l.IdleTimeout,
+			MaxStreams:   l.MaxStreams,
+			PaddingBlock: paddingBlock,
+			FailureRcode: l.FailureRcode,
 		}
 		lis = append(lis, newListener)
 	}
 	return
 }
 
-func parseUpstream(ss []*Upstream) (rss []*resolver.ClientConfig) {
+func parseUpstream(ss []*Upstream, paddingBlock int) (rss []*resolver.ClientConfig) {
 	for _, s := range ss {
 		newUpstream := &resolver.ClientConfig{
-			URL:    s.URL,
-			Weight: s.Weight,
+			URL:             s.URL,
+			Weight:          s.Weight,
+			Timeout:         time.Duration(s.Timeout),
+			DisableTCPRetry: s.DisableTCPRetry,
+			Proxy:           s.Proxy,
+			Bind:            s.Bind,
+			Mark:            s.Mark,
+			PaddingBlock:    paddingBlock,
+			Domains:         s.Domains,
+		}
+		if s.TLS != nil {
+			newUpstream.TLS = &dns.TLSOptions{
+				ServerName: s.TLS.ServerName,
+				CAFile:     s.TLS.CAFile,
+				CertFile:   s.TLS.CertFile,
+				KeyFile:    s.TLS.KeyFile,
+				SPKIPins:   s.TLS.SPKIPins,
+			}
 		}
 		rss = append(rss, newUpstream)
 	}
 	return
 }
 
+// parseServers parses the upstream of the bootstrap and private reverse
+// resolvers, which are used for every name.
+func parseServers(ss []*Upstream, paddingBlock int) []*resolver.ClientConfig {
+	rss := parseUpstream(ss, paddingBlock)
+	for _, s := range rss {
+		s.Domains = nil
+	}
+	return rss
+}
+
+func parseZones(zs []*Zone) (rzs []*resolver.ZoneConfig) {
+	for _, z := range zs {
+		newZone := &resolver.ZoneConfig{
+			File:   z.File,
+			Origin: z.Origin,
+		}
+		rzs = append(rzs, newZone)
+	}
+	return
+}
+
 func parseConfig(configFilePath string) (*Config, error) {
 	config := new(Config)
 
@@ -98,38 +288,64 @@ func main() {
 	}
 
 	resolverConfig := &resolver.Config{
-		ClientsConfig: parseUpstream(config.Upstream),
-		Cache:         config.Cache,
-		Strategy:      config.Strategy,
-		MaxRetries:    config.MaxRetries,
+		ClientsConfig:               parseUpstream(config.Upstream, config.Padding.query()),
+		Cache:                       config.Cache,
+		Strategy:                    config.Strategy,
+		MaxRetries:                  config.MaxRetries,
+		PrivateReverse:              config.PrivateReverse.Policy,
+		PrivateReverseClientsConfig: parseServers(config.PrivateReverse.Upstream, config.Padding.query()),
+		ECS: &resolver.ECSConfig{
+			Mode:       config.ECS.Mode,
+			IPv4Prefix: config.ECS.IPv4Prefix,
+			IPv6Prefix: config.ECS.IPv6Prefix,
+			Subnet:     config.ECS.Subnet,
+		},
+	}
+	if config.DNSSEC.Enable {
+		resolverConfig.DNSSEC = &resolver.DNSSECConfig{
+			TrustAnchors:    config.DNSSEC.TrustAnchors,
+			TrustAnchorFile: config.DNSSEC.TrustAnchorFile,
+		}
 	}
+	if config.DNS64.Enable {
+		resolverConfig.DNS64 = &resolver.DNS64Config{
+			Prefix:         config.DNS64.Prefix,
+			Exclude:        config.DNS64.Exclude,
+			ExcludeDomains: config.DNS64.ExcludeDomains,
+			Clients:        config.DNS64.Clients,
+		}
+	}
+	addressFamily := &resolver.AddressFamilyConfig{Mode: config.AddressFamily.Mode}
+	for _, g := range config.AddressFamily.Groups {
+		addressFamily.Groups = append(addressFamily.Groups, &resolver.AddressFamilyGroup{
+			Clients: g.Clients,
+			Mode:    g.Mode,
+		})
+	}
+	resolverConfig.AddressFamily = addressFamily
 	r, err := resolver.NewResolver(resolverConfig)
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
 
-	var bootstrap []*resolver.ClientConfig
-	for _, s := range config.BootStrap {
-		newServer := new(resolver.ClientConfig)
-		newServer.URL = s
-		bootstrap = append(bootstrap, newServer)
-	}
-	if len(bootstrap) == 0 {
+	bootstrapUpstream := config.BootStrap
+	if len(bootstrapUpstream) == 0 {
 		for _, s := range config.Upstream {
 			host, _ := url.Parse(s.URL)
 			ip := net.ParseIP(host.Hostname())
 			if ip != nil {
-				newServer := new(resolver.ClientConfig)
-				newServer.URL = s.URL
-				bootstrap = append(bootstrap, newServer)
+				bootstrapUpstream = append(bootstrapUpstream, s)
 			}
 		}
 	}
+	bootstrap := parseServers(bootstrapUpstream, config.Padding.query())
 	if len(bootstrap) > 0 {
 		defaultResolverConfig := &resolver.Config{
 			ClientsConfig: bootstrap,
 			Strategy:      "random",
+			// the upstream hosts are resolved with the global mode
+			AddressFamily: &resolver.AddressFamilyConfig{Mode: config.AddressFamily.Mode},
 		}
 		defaultResolver, err := resolver.NewResolver(defaultResolverConfig)
 		if err != nil {
@@ -137,17 +353,40 @@ func main() {
 			return
 		}
 		dns.SetResolver(defaultResolver)
+	} else {
+		dns.SetFamily(config.AddressFamily.Mode)
+	}
+
+	if len(config.HostsFile) > 0 {
+		r.Hosts = resolver.LoadHosts(config.HostsFile...)
+		r.ListenHostsFile(config.HostsFile...)
+	}
+
+	if len(config.Leases.Dnsmasq) > 0 || len(config.Leases.Dhcpd) > 0 {
+		leasesConfig := &resolver.LeasesConfig{
+			Domain:  config.Leases.Domain,
+			Dnsmasq: config.Leases.Dnsmasq,
+			Dhcpd:   config.Leases.Dhcpd,
+		}
+		leases, err := resolver.LoadLeases(leasesConfig)
+		if err != nil {
+			log.Printf("Couldn't load lease file: %v\n", err.Error())
+		} else {
+			r.Leases = leases
+			r.ListenLeaseFiles(leasesConfig)
+		}
 	}
 
-	if config.HostsFile != "" {
-		hosts, err := resolver.LoadHosts(config.HostsFile)
+	if len(config.Zones) > 0 {
+		zoneConfigs := parseZones(config.Zones)
+		zones, err := resolver.LoadZones(zoneConfigs...)
 		if err != nil {
-			log.Printf("Couldn't load hosts file: %v\n", err.Error())
+			log.Printf("Couldn't load zone file: %v\n", err.Error())
 		} else {
-			r.Hosts = hosts
-			r.ListenHostsFile(config.HostsFile)
+			r.Zones = zones
+			r.ListenZoneFiles(zoneConfigs...)
 		}
 	}
 
-	listener.Start(parseListener(config.Listener), r)
+	listener.Start(parseListener(config.Listener, config.Padding.response()), r)
 }
@@ -0,0 +1,210 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+
+	D "github.com/miekg/dns"
+)
+
+const (
+	// defaultDNS64Prefix is the well-known prefix of RFC 6052
+	defaultDNS64Prefix = "64:ff9b::/96"
+	// the TTL of the answers synthesized without a SOA (RFC 6147 section 5.1.7)
+	defaultDNS64TTL = 600
+)
+
+// defaultDNS64Exclude are the AAAA records treated as absent, the
+// IPv4-mapped addresses (RFC 6147 section 5.1.4).
+var defaultDNS64Exclude = []string{"::ffff:0:0/96"}
+
+type DNS64Config struct {
+	// Prefix is the NAT64 prefix, 64:ff9b::/96 if empty
+	Prefix string
+	// Exclude are the IPv6 ranges of the AAAA records ignored, so the
+	// names with only these are synthesized, ::ffff:0:0/96 if empty
+	Exclude []string
+	// ExcludeDomains are the domains never synthesized
+	ExcludeDomains []string
+	// Clients are the IPs or subnets of the clients served with DNS64,
+	// all the clients if empty
+	Clients []string
+}
+
+// dns64 synthesizes the AAAA records from the A records (RFC 6147).
+type dns64 struct {
+	prefix *net.IPNet
+	// wellKnown is set for the well-known prefix, which mustn't be used
+	// for the non-global IPv4 addresses (RFC 6052 section 3.1)
+	wellKnown      bool
+	exclude        subnets
+	excludeDomains map[string]bool
+	clients        subnets
+}
+
+func newDNS64(config *DNS64Config) (d *dns64, err error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultDNS64Prefix
+	}
+	ip, subnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix: %w", err)
+	}
+	// the lengths of RFC 6052 section 2.2, whose bits 64 to 71 are zero
+	ones, bits := subnet.Mask.Size()
+	switch {
+	case ip.To4() != nil || bits != 128:
+		return nil, fmt.Errorf("invalid DNS64 prefix %s: not IPv6", prefix)
+	case ones != 32 && ones != 40 && ones != 48 && ones != 56 && ones != 64 && ones != 96:
+		return nil, fmt.Errorf("invalid DNS64 prefix %s: length must be 32, 40, 48, 56, 64 or 96", prefix)
+	case subnet.IP[8] != 0:
+		return nil, fmt.Errorf("invalid DNS64 prefix %s: bits 64 to 71 must be zero", prefix)
+	}
+	_, wellKnown, _ := net.ParseCIDR(defaultDNS64Prefix)
+	d = &dns64{
+		prefix:         subnet,
+		wellKnown:      subnet.String() == wellKnown.String(),
+		excludeDomains: make(map[string]bool),
+	}
+
+	exclude := config.Exclude
+	if len(exclude) == 0 {
+		exclude = defaultDNS64Exclude
+	}
+	if d.exclude, err = parseSubnets(exclude); err != nil {
+		return nil, fmt.Errorf("invalid DNS64 exclude: %w", err)
+	}
+	for _, domain := range config.ExcludeDomains {
+		d.excludeDomains[D.CanonicalName(domain)] = true
+	}
+	if d.clients, err = parseSubnets(config.Clients); err != nil {
+		return nil, fmt.Errorf("invalid DNS64 clients: %w", err)
+	}
+	return d, nil
+}
+
+// applies reports whether the answer to the query m from the client at
+// addr may be synthesized.
+func (d *dns64) applies(m *D.Msg, addr string) bool {
+	if d == nil {
+		return false
+	}
+	q := m.Question[0]
+	if q.Qtype != D.TypeAAAA || q.Qclass != D.ClassINET {
+		return false
+	}
+	// a validating client gets the real answer (RFC 6147 section 5.5)
+	if opt := m.IsEdns0(); opt != nil && opt.Do() && m.CheckingDisabled {
+		return false
+	}
+	for name := D.CanonicalName(q.Name); ; name = parent(name) {
+		if d.excludeDomains[name] {
+			return false
+		}
+		if name == "." {
+			break
+		}
+	}
+	return len(d.clients) == 0 || d.clients.contains(hostIP(addr))
+}
+
+// needed reports whether msg, the answer to an AAAA query, has no AAAA
+// records but the excluded ones. A name error isn't synthesized.
+func (d *dns64) needed(msg *D.Msg) bool {
+	if msg == nil || msg.Rcode != D.RcodeSuccess {
+		return false
+	}
+	for _, rr := range msg.Answer {
+		if aaaa, ok := rr.(*D.AAAA); ok && !d.exclude.contains(aaaa.AAAA) {
+			return false
+		}
+	}
+	return true
+}
+
+// embed returns the IPv6 address of ip4 in the prefix (RFC 6052 section 2.2).
+func (d *dns64) embed(ip4 net.IP) net.IP {
+	ones, _ := d.prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix.IP)
+	i := ones / 8
+	for _, b := range ip4 {
+		// skip the octet of bits 64 to 71
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// negativeTTL returns the TTL of the negative answer msg, from its SOA.
+func negativeTTL(msg *D.Msg) uint32 {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*D.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return defaultDNS64TTL
+}
+
+// synthesize returns the answer to the AAAA query answered with msg,
+// made from a, the answer to the A query of the same name. The CNAMEs
+// are kept, the A records are replaced by the AAAA records of their
+// addresses, with a TTL no longer than the one of the negative answer.
+// msg is returned if a has no A records to synthesize from.
+func (d *dns64) synthesize(msg, a *D.Msg) *D.Msg {
+	if a.Rcode != D.RcodeSuccess {
+		return msg
+	}
+
+	ttl := negativeTTL(msg)
+	ret := a.Copy()
+	ret.Question = append([]D.Question(nil), msg.Question...)
+	ret.Answer = nil
+	synthesized := false
+	for _, rr := range a.Answer {
+		switch rr := rr.(type) {
+		case *D.A:
+			ip4 := rr.A.To4()
+			if ip4 == nil || d.wellKnown && (!ip4.IsGlobalUnicast() || ip4.IsPrivate()) {
+				continue
+			}
+			hdr := rr.Hdr
+			hdr.Rrtype = D.TypeAAAA
+			hdr.Rdlength = 0
+			if hdr.Ttl > ttl {
+				hdr.Ttl = ttl
+			}
+			ret.Answer = append(ret.Answer, &D.AAAA{Hdr: hdr, AAAA: d.embed(ip4)})
+			synthesized = true
+		case *D.RRSIG:
+			// the signatures of the A records don't cover the synthesized ones
+			if rr.TypeCovered != D.TypeA {
+				ret.Answer = append(ret.Answer, D.Copy(rr))
+			}
+		default:
+			ret.Answer = append(ret.Answer, D.Copy(rr))
+		}
+	}
+	if !synthesized {
+		return msg
+	}
+
+	ret.Ns = nil
+	ret.Extra = nil
+	if opt := a.IsEdns0(); opt != nil {
+		ret.Extra = append(ret.Extra, D.Copy(opt))
+	}
+	ret.AuthenticatedData = msg.AuthenticatedData && a.AuthenticatedData
+	return ret
+}
@@ -0,0 +1,240 @@
+package resolver
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	D "github.com/miekg/dns"
+)
+
+func newTestDNS64(t *testing.T, config *DNS64Config) *dns64 {
+	t.Helper()
+	d, err := newDNS64(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDNS64Embed(t *testing.T) {
+	// the examples of RFC 6052 section 2.4
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			d := newTestDNS64(t, &DNS64Config{Prefix: tt.prefix})
+			if got := d.embed(net.ParseIP("192.0.2.33").To4()).String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	for _, prefix := range []string{"2001:db8::/33", "2001:db8:0:0:100::/72", "192.0.2.0/24"} {
+		if _, err := newDNS64(&DNS64Config{Prefix: prefix}); err == nil {
+			t.Errorf("prefix %s accepted", prefix)
+		}
+	}
+	if _, err := newDNS64(&DNS64Config{Prefix: "2001:db8:0:0:100::/96"}); err == nil {
+		t.Error("prefix with bits 64 to 71 set accepted")
+	}
+}
+
+// testMsg returns the answer to name and qtype with the records of rrs,
+// the SOA ones in the authority section.
+func testMsg(t *testing.T, name string, qtype uint16, rrs ...string) *D.Msg {
+	t.Helper()
+	msg := new(D.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.Response = true
+	for _, s := range rrs {
+		rr, err := D.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rr.(*D.SOA); ok {
+			msg.Ns = append(msg.Ns, rr)
+		} else {
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	return msg
+}
+
+func TestDNS64Needed(t *testing.T) {
+	d := newTestDNS64(t, &DNS64Config{})
+	nxdomain := testMsg(t, "www.example.org.", D.TypeAAAA)
+	nxdomain.Rcode = D.RcodeNameError
+
+	tests := []struct {
+		name string
+		msg  *D.Msg
+		want bool
+	}{
+		{"nodata", testMsg(t, "www.example.org.", D.TypeAAAA,
+			"example.org. 300 IN SOA ns.example.org. admin.example.org. 1 3600 600 86400 300"), true},
+		{"aaaa", testMsg(t, "www.example.org.", D.TypeAAAA, "www.example.org. 300 IN AAAA 2001:db8::1"), false},
+		{"only excluded", testMsg(t, "www.example.org.", D.TypeAAAA,
+			"www.example.org. 300 IN AAAA ::ffff:192.0.2.1",
+			"www.example.org. 300 IN AAAA ::ffff:192.0.2.2"), true},
+		{"excluded and aaaa", testMsg(t, "www.example.org.", D.TypeAAAA,
+			"www.example.org. 300 IN AAAA ::ffff:192.0.2.1",
+			"www.example.org. 300 IN AAAA 2001:db8::1"), false},
+		{"cname only", testMsg(t, "www.example.org.", D.TypeAAAA, "www.example.org. 300 IN CNAME web.example.org."), true},
+		{"nxdomain", nxdomain, false},
+	}
+	for _, tt := range tests {
+		if got := d.needed(tt.msg); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDNS64Synthesize(t *testing.T) {
+	const soa = "example.org. 3600 IN SOA ns.example.org. admin.example.org. 1 3600 600 86400 60"
+	tests := []struct {
+		name   string
+		prefix string
+		// nodata is the answer to the AAAA query, a to the A query
+		nodata []string
+		a      []string
+		// want are the records of the answer, nil for the AAAA answer
+		want []string
+	}{
+		{
+			name:   "ttl capped by soa",
+			nodata: []string{soa},
+			a:      []string{"www.example.org. 300 IN A 192.0.2.33"},
+			want:   []string{"www.example.org.\t60\tIN\tAAAA\t64:ff9b::c000:221"},
+		},
+		{
+			name:   "ttl kept under soa",
+			nodata: []string{soa},
+			a:      []string{"www.example.org. 30 IN A 198.51.100.1"},
+			want:   []string{"www.example.org.\t30\tIN\tAAAA\t64:ff9b::c633:6401"},
+		},
+		{
+			name:   "ttl without soa",
+			nodata: nil,
+			a:      []string{"www.example.org. 3600 IN A 198.51.100.1"},
+			want:   []string{"www.example.org.\t600\tIN\tAAAA\t64:ff9b::c633:6401"},
+		},
+		{
+			name:   "cname and rrsig",
+			nodata: []string{soa},
+			a: []string{
+				"www.example.org. 30 IN CNAME web.example.org.",
+				"www.example.org. 30 IN RRSIG CNAME 13 3 30 20300101000000 20200101000000 1 example.org. AAAA",
+				"web.example.org. 30 IN A 198.51.100.1",
+				"web.example.org. 30 IN RRSIG A 13 3 30 20300101000000 20200101000000 1 example.org. AAAA",
+			},
+			want: []string{
+				"www.example.org.\t30\tIN\tCNAME\tweb.example.org.",
+				"www.example.org.\t30\tIN\tRRSIG\tCNAME 13 3 30 20300101000000 20200101000000 1 example.org. AAAA",
+				"web.example.org.\t30\tIN\tAAAA\t64:ff9b::c633:6401",
+			},
+		},
+		{
+			name:   "non-global dropped by well-known prefix",
+			nodata: []string{soa},
+			a: []string{
+				"www.example.org. 30 IN A 10.0.0.1",
+				"www.example.org. 30 IN A 198.51.100.1",
+			},
+			want: []string{"www.example.org.\t30\tIN\tAAAA\t64:ff9b::c633:6401"},
+		},
+		{
+			name:   "only non-global under well-known prefix",
+			nodata: []string{soa},
+			a:      []string{"www.example.org. 30 IN A 192.168.1.1"},
+		},
+		{
+			name:   "non-global kept by network-specific prefix",
+			prefix: "2001:db8:64::/96",
+			nodata: []string{soa},
+			a:      []string{"www.example.org. 30 IN A 192.168.1.1"},
+			want:   []string{"www.example.org.\t30\tIN\tAAAA\t2001:db8:64::c0a8:101"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDNS64(t, &DNS64Config{Prefix: tt.prefix})
+			msg := testMsg(t, "www.example.org.", D.TypeAAAA, tt.nodata...)
+			a := testMsg(t, "www.example.org.", D.TypeA, tt.a...)
+
+			ret := d.synthesize(msg, a)
+			if tt.want == nil {
+				if ret != msg {
+					t.Fatalf("got %v, want the AAAA answer", ret.Answer)
+				}
+				return
+			}
+			if q := ret.Question[0]; q.Qtype != D.TypeAAAA {
+				t.Errorf("question %s, want AAAA", D.TypeToString[q.Qtype])
+			}
+			var got []string
+			for _, rr := range ret.Answer {
+				got = append(got, rr.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if len(ret.Ns) > 0 {
+				t.Errorf("authority %v kept", ret.Ns)
+			}
+		})
+	}
+}
+
+func TestDNS64Applies(t *testing.T) {
+	d := newTestDNS64(t, &DNS64Config{
+		ExcludeDomains: []string{"Example.NET"},
+		Clients:        []string{"192.168.1.0/24"},
+	})
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		do, cd bool
+		addr   string
+		want   bool
+	}{
+		{name: "aaaa", qname: "www.example.org.", qtype: D.TypeAAAA, addr: "192.168.1.2:53", want: true},
+		{name: "a", qname: "www.example.org.", qtype: D.TypeA, addr: "192.168.1.2:53"},
+		{name: "do", qname: "www.example.org.", qtype: D.TypeAAAA, do: true, addr: "192.168.1.2:53", want: true},
+		{name: "cd", qname: "www.example.org.", qtype: D.TypeAAAA, cd: true, addr: "192.168.1.2:53", want: true},
+		{name: "do and cd", qname: "www.example.org.", qtype: D.TypeAAAA, do: true, cd: true, addr: "192.168.1.2:53"},
+		{name: "excluded domain", qname: "example.net.", qtype: D.TypeAAAA, addr: "192.168.1.2:53"},
+		{name: "below excluded domain", qname: "www.EXAMPLE.net.", qtype: D.TypeAAAA, addr: "192.168.1.2:53"},
+		{name: "other client", qname: "www.example.org.", qtype: D.TypeAAAA, addr: "192.168.2.2:53"},
+	}
+	for _, tt := range tests {
+		m := new(D.Msg)
+		m.SetQuestion(tt.qname, tt.qtype)
+		m.CheckingDisabled = tt.cd
+		if tt.do {
+			m.SetEdns0(4096, true)
+		}
+		if got := d.applies(m, tt.addr); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	var disabled *dns64
+	m := new(D.Msg)
+	m.SetQuestion("www.example.org.", D.TypeAAAA)
+	if disabled.applies(m, "192.168.1.2:53") {
+		t.Error("applies without DNS64")
+	}
+}
@@ -0,0 +1,647 @@
+package resolver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	LEC "github.com/zekexy/leedns/cache"
+	D "github.com/miekg/dns"
+)
+
+// DNSSECConfig makes the resolver a validating forwarder (RFC 4035).
+type DNSSECConfig struct {
+	// TrustAnchors are the DS or DNSKEY records of the root zone,
+	// the root KSKs published by IANA if empty
+	TrustAnchors []string
+	// TrustAnchorFile keeps the root trust anchors updated with
+	// RFC 5011, the anchors are only static if empty
+	TrustAnchorFile string
+}
+
+// security is the result of the validation of some data.
+type security int
+
+const (
+	secure security = iota
+	// insecure is the data under a delegation proven to be unsigned
+	insecure
+	bogus
+)
+
+const (
+	// maxNSEC3Iterations are the most iterations of the NSEC3 records
+	// treated as secure, the zones with more are insecure (RFC 9276)
+	maxNSEC3Iterations = 150
+	// maxKeysTTL is the longest time the validated keys are kept
+	maxKeysTTL = 24 * time.Hour
+)
+
+// zoneKeys are the validated DNSKEYs of a zone, or no keys if the zone
+// is insecure.
+type zoneKeys struct {
+	zone   string
+	keys   []*D.DNSKEY
+	expire time.Time
+}
+
+type validator struct {
+	r       *Resolver
+	anchors *trustAnchors
+	// keys are the zoneKeys of the names, the names which aren't
+	// zone cuts share the keys of the zone they are in
+	keys *LEC.LruExpiresCache
+}
+
+func newValidator(r *Resolver, config *DNSSECConfig) (*validator, error) {
+	anchors, err := newTrustAnchors(config)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := LEC.New(1024)
+	if err != nil {
+		return nil, err
+	}
+	return &validator{r: r, anchors: anchors, keys: keys}, nil
+}
+
+// bogusError is the error of the data failing the validation.
+func bogusError(code uint16, format string, a ...interface{}) error {
+	text := fmt.Sprintf(format, a...)
+	return &ExtendedError{Code: code, Text: text, Err: fmt.Errorf("DNSSEC validation failed: %s", text)}
+}
+
+// supportedAlgorithm reports whether the signatures of alg can be verified.
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case D.RSASHA1, D.RSASHA1NSEC3SHA1, D.RSASHA256, D.RSASHA512,
+		D.ECDSAP256SHA256, D.ECDSAP384SHA384, D.ED25519:
+		return true
+	}
+	return false
+}
+
+// query sends a query for the validation to the upstreams, with CD set
+// to get the data even if the upstreams find it bogus.
+func (v *validator) query(name string, qtype uint16) (*D.Msg, error) {
+	m := new(D.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(4096, true)
+	m.CheckingDisabled = true
+
+	msg, err := v.r.strategy(m)
+	if msg == nil {
+		return nil, upstreamError(err)
+	}
+	if msg.Rcode != D.RcodeSuccess && msg.Rcode != D.RcodeNameError {
+		return nil, &ExtendedError{Code: D.ExtendedErrorCodeDNSSECIndeterminate,
+			Text: fmt.Sprintf("%s %s failed", name, D.TypeToString[qtype]),
+			Err:  fmt.Errorf("DNSSEC query %s %s: %s", name, D.TypeToString[qtype], D.RcodeToString[msg.Rcode])}
+	}
+	return msg, nil
+}
+
+// rrset is the records of the same name and type with their signatures.
+type rrset struct {
+	name  string
+	rtype uint16
+	rrs   []D.RR
+	sigs  []*D.RRSIG
+}
+
+// splitRRsets groups rrs into RRsets in the order they appear.
+func splitRRsets(rrs []D.RR) (sets []*rrset) {
+	index := make(map[string]*rrset)
+	get := func(name string, rtype uint16) *rrset {
+		name = D.CanonicalName(name)
+		key := fmt.Sprintf("%s %d", name, rtype)
+		s, ok := index[key]
+		if !ok {
+			s = &rrset{name: name, rtype: rtype}
+			index[key] = s
+			sets = append(sets, s)
+		}
+		return s
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if sig, ok := rr.(*D.RRSIG); ok {
+			s := get(h.Name, sig.TypeCovered)
+			s.sigs = append(s.sigs, sig)
+			continue
+		}
+		s := get(h.Name, h.Rrtype)
+		s.rrs = append(s.rrs, rr)
+	}
+
+	// the signatures of no records
+	ret := sets[:0]
+	for _, s := range sets {
+		if len(s.rrs) > 0 {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// parent returns the name without its first label, "." for the root.
+func parent(name string) string {
+	i, end := D.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+// zoneKeys returns the keys of the zone at name, or of the zone name is
+// in if it isn't a zone cut. The chain of trust is followed from the root.
+func (v *validator) zoneKeys(name string) (*zoneKeys, error) {
+	name = D.CanonicalName(name)
+	if cached, expire, hit := v.keys.Get(name); hit && time.Now().Before(expire) {
+		return cached.(*zoneKeys), nil
+	}
+
+	var zk *zoneKeys
+	var err error
+	if name == "." {
+		zk, err = v.rootKeys()
+	} else {
+		zk, err = v.childKeys(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.keys.Add(name, zk, zk.expire)
+	return zk, nil
+}
+
+// expireOf returns the time the validated set expires.
+func expireOf(set *rrset) time.Time {
+	ttl := time.Duration(set.rrs[0].Header().Ttl) * time.Second
+	if ttl > maxKeysTTL {
+		ttl = maxKeysTTL
+	}
+	return time.Now().Add(ttl)
+}
+
+// earlier returns the earlier one of t and u.
+func earlier(t, u time.Time) time.Time {
+	if u.Before(t) {
+		return u
+	}
+	return t
+}
+
+// findRRset returns the RRset of name and rtype in sets.
+func findRRset(sets []*rrset, name string, rtype uint16) *rrset {
+	name = D.CanonicalName(name)
+	for _, s := range sets {
+		if s.name == name && s.rtype == rtype {
+			return s
+		}
+	}
+	return nil
+}
+
+// selfSigned returns the DNSKEYs of the zone if the DNSKEY RRset is
+// signed by one of the trusted keys.
+func selfSigned(set *rrset, trusted []*D.DNSKEY) ([]*D.DNSKEY, error) {
+	now := time.Now()
+	err := bogusError(D.ExtendedErrorCodeDNSKEYMissing, "no trusted key signs the DNSKEY of %s", set.name)
+	for _, sig := range set.sigs {
+		for _, k := range trusted {
+			if sig.KeyTag != k.KeyTag() || sig.Algorithm != k.Algorithm || sig.Verify(k, set.rrs) != nil {
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				err = bogusError(D.ExtendedErrorCodeSignatureExpired, "the signature of the DNSKEY of %s expired", set.name)
+				continue
+			}
+			var keys []*D.DNSKEY
+			for _, rr := range set.rrs {
+				if k, ok := rr.(*D.DNSKEY); ok && k.Flags&D.ZONE != 0 && k.Flags&D.REVOKE == 0 {
+					keys = append(keys, k)
+				}
+			}
+			return keys, nil
+		}
+	}
+	return nil, err
+}
+
+// rootKeys validates the DNSKEYs of the root zone with the trust anchors.
+func (v *validator) rootKeys() (*zoneKeys, error) {
+	msg, err := v.query(".", D.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	set := findRRset(splitRRsets(msg.Answer), ".", D.TypeDNSKEY)
+	if set == nil {
+		return nil, bogusError(D.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of the root")
+	}
+
+	keys, err := selfSigned(set, v.anchors.trusted(set.rrs))
+	if err != nil {
+		return nil, err
+	}
+	v.anchors.update(set)
+	return &zoneKeys{zone: ".", keys: keys, expire: expireOf(set)}, nil
+}
+
+// childKeys follows the chain of trust from the zone of the parent of
+// name to name.
+func (v *validator) childKeys(name string) (*zoneKeys, error) {
+	up, err := v.zoneKeys(parent(name))
+	if err != nil {
+		return nil, err
+	}
+	if up.keys == nil {
+		return up, nil
+	}
+
+	msg, err := v.query(name, D.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	ds := findRRset(splitRRsets(msg.Answer), name, D.TypeDS)
+	if ds == nil {
+		return v.noDS(msg, name, up)
+	}
+
+	sec, _, err := v.verifyRRset(ds, up.zone)
+	if err != nil {
+		return nil, err
+	}
+	if sec == insecure {
+		return &zoneKeys{zone: name, expire: earlier(up.expire, expireOf(ds))}, nil
+	}
+
+	// the zone is insecure if none of its DS can be used (RFC 4035 section 5.2)
+	var usable []*D.DS
+	for _, rr := range ds.rrs {
+		if d, ok := rr.(*D.DS); ok && supportedAlgorithm(d.Algorithm) &&
+			(d.DigestType == D.SHA1 || d.DigestType == D.SHA256 || d.DigestType == D.SHA384) {
+			usable = append(usable, d)
+		}
+	}
+	if len(usable) == 0 {
+		return &zoneKeys{zone: name, expire: earlier(up.expire, expireOf(ds))}, nil
+	}
+
+	msg, err = v.query(name, D.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	set := findRRset(splitRRsets(msg.Answer), name, D.TypeDNSKEY)
+	if set == nil {
+		return nil, bogusError(D.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of %s", name)
+	}
+
+	var trusted []*D.DNSKEY
+	for _, rr := range set.rrs {
+		k, ok := rr.(*D.DNSKEY)
+		if !ok {
+			continue
+		}
+		for _, d := range usable {
+			if kd := k.ToDS(d.DigestType); kd != nil && kd.KeyTag == d.KeyTag &&
+				kd.Algorithm == d.Algorithm && strings.EqualFold(kd.Digest, d.Digest) {
+				trusted = append(trusted, k)
+				break
+			}
+		}
+	}
+	keys, err := selfSigned(set, trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &zoneKeys{zone: name, keys: keys, expire: earlier(up.expire, earlier(expireOf(ds), expireOf(set)))}, nil
+}
+
+// noDS checks the answer without the DS of name in the zone up, name
+// is an insecure delegation, or not a zone cut and in the zone up.
+func (v *validator) noDS(msg *D.Msg, name string, up *zoneKeys) (*zoneKeys, error) {
+	nsecs, nsec3s, sec, err := v.verifyDenial(msg, name, up.zone)
+	if err != nil {
+		return nil, err
+	}
+	expire := up.expire
+	if ttl := minTTL(msg.Ns); ttl < time.Until(expire) {
+		expire = time.Now().Add(ttl)
+	}
+	if sec == insecure {
+		return &zoneKeys{zone: name, expire: expire}, nil
+	}
+
+	if msg.Rcode == D.RcodeNameError {
+		// in an opt-out span, name may be an unsigned delegation
+		optOut, err := denyName(nsecs, nsec3s, name)
+		if err != nil {
+			return nil, err
+		}
+		if optOut {
+			return &zoneKeys{zone: name, expire: expire}, nil
+		}
+		return &zoneKeys{zone: up.zone, keys: up.keys, expire: expire}, nil
+	}
+
+	cut, optOut, err := denyDS(nsecs, nsec3s, name)
+	if err != nil {
+		return nil, err
+	}
+	if cut || optOut {
+		return &zoneKeys{zone: name, expire: expire}, nil
+	}
+	return &zoneKeys{zone: up.zone, keys: up.keys, expire: expire}, nil
+}
+
+// minTTL returns the smallest TTL of rrs.
+func minTTL(rrs []D.RR) time.Duration {
+	ttl := maxKeysTTL
+	for _, rr := range rrs {
+		if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	return ttl
+}
+
+// verifyRRset verifies the signatures of set, which must be signed by the
+// secure zone, or any zone if it is empty. It returns the closest encloser
+// of the wildcard if set is expanded from one.
+func (v *validator) verifyRRset(set *rrset, zone string) (sec security, wildcard string, err error) {
+	if len(set.sigs) == 0 && zone != "" {
+		return bogus, "", bogusError(D.ExtendedErrorCodeRRSIGsMissing, "no RRSIG for %s %s", set.name, D.TypeToString[set.rtype])
+	}
+	if len(set.sigs) == 0 {
+		zk, err := v.zoneKeys(set.name)
+		if err != nil {
+			return bogus, "", err
+		}
+		if zk.keys == nil {
+			return insecure, "", nil
+		}
+		return bogus, "", bogusError(D.ExtendedErrorCodeRRSIGsMissing, "no RRSIG for %s %s", set.name, D.TypeToString[set.rtype])
+	}
+
+	now := time.Now()
+	err = bogusError(D.ExtendedErrorCodeDNSBogus, "no valid RRSIG for %s %s", set.name, D.TypeToString[set.rtype])
+	for _, sig := range set.sigs {
+		signer := D.CanonicalName(sig.SignerName)
+		if zone != "" && signer != zone || !D.IsSubDomain(signer, set.name) {
+			continue
+		}
+		zk, e := v.zoneKeys(signer)
+		if e != nil {
+			return bogus, "", e
+		}
+		if zk.keys == nil {
+			return insecure, "", nil
+		}
+		if zk.zone != signer {
+			continue
+		}
+		for _, k := range zk.keys {
+			if sig.KeyTag != k.KeyTag() || sig.Algorithm != k.Algorithm || sig.Verify(k, set.rrs) != nil {
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				err = bogusError(D.ExtendedErrorCodeSignatureExpired, "the RRSIG of %s %s expired", set.name, D.TypeToString[set.rtype])
+				continue
+			}
+			// fewer labels than the owner, expanded from a wildcard (RFC 4035 section 5.3.4)
+			if labels := D.CountLabel(set.name); int(sig.Labels) < labels {
+				wildcard = strings.Join(D.SplitDomainName(set.name)[labels-int(sig.Labels):], ".") + "."
+			}
+			return secure, wildcard, nil
+		}
+	}
+	return bogus, "", err
+}
+
+// zoneOf returns the keys of the zone the records of name and qtype are
+// in, the DS of a zone cut is in the parent zone.
+func (v *validator) zoneOf(name string, qtype uint16) (*zoneKeys, error) {
+	if qtype == D.TypeDS && name != "." {
+		name = parent(name)
+	}
+	return v.zoneKeys(name)
+}
+
+// verifyDenial verifies the SOA, NSEC and NSEC3 records of the authority
+// section of the negative answer msg for name, signed by the secure zone
+// name is in. The ones of another zone, like the NSEC of the delegation
+// in the parent zone, prove nothing about name.
+func (v *validator) verifyDenial(msg *D.Msg, name, zone string) (nsecs []*D.NSEC, nsec3s []*D.NSEC3, sec security, err error) {
+	for _, set := range splitRRsets(msg.Ns) {
+		switch set.rtype {
+		case D.TypeSOA, D.TypeNSEC, D.TypeNSEC3:
+		default:
+			continue
+		}
+		s, _, err := v.verifyRRset(set, zone)
+		if err != nil {
+			return nil, nil, bogus, err
+		}
+		if s == insecure {
+			return nil, nil, insecure, nil
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *D.NSEC:
+				nsecs = append(nsecs, rr)
+			case *D.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		return nil, nil, bogus, bogusError(D.ExtendedErrorCodeNSECMissing, "no NSEC or NSEC3 for %s", name)
+	}
+	for _, n := range nsec3s {
+		if n.Iterations > maxNSEC3Iterations {
+			return nil, nil, insecure, nil
+		}
+	}
+	return nsecs, nsec3s, secure, nil
+}
+
+// validate validates the response msg to the question q, the wildcard
+// expansions and the negative answers must be proven.
+func (v *validator) validate(q D.Question, msg *D.Msg) (security, error) {
+	// the failures are passed to the clients as they are
+	if msg.Rcode != D.RcodeSuccess && msg.Rcode != D.RcodeNameError {
+		return insecure, nil
+	}
+
+	sec := secure
+	answer := splitRRsets(msg.Answer)
+	for _, set := range answer {
+		// the CNAME synthesized from a DNAME isn't signed (RFC 6672 section 5.3.1)
+		if set.rtype == D.TypeCNAME && len(set.sigs) == 0 && dnameOf(answer, set.name) {
+			continue
+		}
+		s, wildcard, err := v.verifyRRset(set, "")
+		if err != nil {
+			return bogus, err
+		}
+		if s == insecure {
+			sec = insecure
+			continue
+		}
+		if wildcard == "" {
+			continue
+		}
+		// the name doesn't exist, or the wildcard wouldn't be used
+		zk, err := v.zoneOf(set.name, set.rtype)
+		if err != nil {
+			return bogus, err
+		}
+		if zk.keys == nil {
+			sec = insecure
+			continue
+		}
+		nsecs, nsec3s, s, err := v.verifyDenial(msg, set.name, zk.zone)
+		if err != nil {
+			return bogus, err
+		}
+		if s == insecure {
+			sec = insecure
+			continue
+		}
+		if err = denyWildcardName(nsecs, nsec3s, set.name, wildcard); err != nil {
+			return bogus, err
+		}
+	}
+
+	target := chainTarget(answer, q.Name)
+	if q.Qtype == D.TypeANY && len(answer) > 0 || findRRset(answer, target, q.Qtype) != nil {
+		return sec, nil
+	}
+	if findRRset(answer, target, D.TypeCNAME) != nil && msg.Rcode == D.RcodeSuccess {
+		return sec, nil
+	}
+
+	zk, err := v.zoneOf(target, q.Qtype)
+	if err != nil {
+		return bogus, err
+	}
+	if zk.keys == nil {
+		return insecure, nil
+	}
+	nsecs, nsec3s, s, err := v.verifyDenial(msg, target, zk.zone)
+	if err != nil {
+		return bogus, err
+	}
+	if s == insecure {
+		return insecure, nil
+	}
+	var optOut bool
+	if msg.Rcode == D.RcodeNameError {
+		optOut, err = denyName(nsecs, nsec3s, target)
+	} else {
+		optOut, err = denyType(nsecs, nsec3s, target, q.Qtype)
+	}
+	if err != nil {
+		return bogus, err
+	}
+	if optOut {
+		return insecure, nil
+	}
+	return sec, nil
+}
+
+// dnameOf reports whether a DNAME of answer is above name.
+func dnameOf(answer []*rrset, name string) bool {
+	for _, set := range answer {
+		if set.rtype == D.TypeDNAME && set.name != name && D.IsSubDomain(set.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// chainTarget follows the CNAME and DNAME records of answer from name.
+func chainTarget(answer []*rrset, name string) string {
+	name = D.CanonicalName(name)
+	for i := 0; i < len(answer); i++ {
+		changed := false
+		for _, set := range answer {
+			switch rr := set.rrs[0].(type) {
+			case *D.CNAME:
+				if set.name == name {
+					name = D.CanonicalName(rr.Target)
+					changed = true
+				}
+			case *D.DNAME:
+				if set.name != name && D.IsSubDomain(set.name, name) {
+					name = D.CanonicalName(strings.TrimSuffix(name, set.name) + rr.Target)
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return name
+}
+
+// check validates the response msg to the query m of a client, unless
+// the client has set CD. The secure answers get the AD bit if the client
+// has set DO or AD, and the bogus ones are errors.
+func (v *validator) check(m, msg *D.Msg) (*D.Msg, error) {
+	q := m.Question[0]
+	do := false
+	if opt := m.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	msg.AuthenticatedData = false
+	if !m.CheckingDisabled {
+		sec, err := v.validate(q, msg)
+		if err != nil {
+			return nil, err
+		}
+		// AD only for the clients asking for it (RFC 6840 section 5.8)
+		msg.AuthenticatedData = sec == secure && (do || m.AuthenticatedData)
+	}
+
+	if !do {
+		stripDNSSEC(msg, q.Qtype)
+	}
+	return msg, nil
+}
+
+// refresh fetches the keys of the root again, which updates the trust
+// anchors.
+func (v *validator) refresh() {
+	zk, err := v.rootKeys()
+	if err != nil {
+		log.Println("Refresh root keys error:", err.Error())
+		return
+	}
+	v.keys.Add(".", zk, zk.expire)
+}
+
+// stripDNSSEC removes the DNSSEC records the client of the query for
+// qtype hasn't asked for (RFC 4035 section 3.2.1).
+func stripDNSSEC(msg *D.Msg, qtype uint16) {
+	strip := func(rrs []D.RR) []D.RR {
+		ret := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case D.TypeRRSIG, D.TypeNSEC, D.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			ret = append(ret, rr)
+		}
+		return ret
+	}
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+	msg.Extra = strip(msg.Extra)
+}
@@ -0,0 +1,786 @@
+package resolver
+
+import (
+	"crypto"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	LEC "github.com/zekexy/leedns/cache"
+	D "github.com/miekg/dns"
+)
+
+// testZone is a zone answered by the fake upstream of the DNSSEC tests,
+// signed with a single key unless it is insecure.
+type testZone struct {
+	t    *testing.T
+	name string
+	// records are the records of the zone by owner, with the NS and DS
+	// of the delegations
+	records map[string][]D.RR
+	key     *D.DNSKEY
+	priv    crypto.Signer
+	nsec3   bool
+	optOut  bool
+	// expired signs the records but the DNSKEY with expired RRSIGs
+	expired bool
+}
+
+func newTestZone(t *testing.T, name string, signed bool, records ...string) *testZone {
+	t.Helper()
+	z := &testZone{t: t, name: name, records: make(map[string][]D.RR)}
+	z.add(name+" 3600 IN SOA ns.invalid. admin.invalid. 1 3600 600 86400 300", name+" 3600 IN NS ns.invalid.")
+	if signed {
+		z.key = &D.DNSKEY{
+			Hdr:   D.RR_Header{Name: name, Rrtype: D.TypeDNSKEY, Class: D.ClassINET, Ttl: 3600},
+			Flags: D.ZONE | D.SEP, Protocol: 3, Algorithm: D.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.priv = priv.(crypto.Signer)
+		z.records[name] = append(z.records[name], z.key)
+	}
+	z.add(records...)
+	return z
+}
+
+func (z *testZone) add(records ...string) {
+	z.t.Helper()
+	for _, s := range records {
+		rr, err := D.NewRR(s)
+		if err != nil {
+			z.t.Fatal(err)
+		}
+		name := D.CanonicalName(rr.Header().Name)
+		z.records[name] = append(z.records[name], rr)
+	}
+}
+
+// delegate adds the delegation to child, with its DS if it is signed.
+func (z *testZone) delegate(child *testZone) {
+	z.add(child.name + " 3600 IN NS ns.invalid.")
+	if child.key != nil {
+		z.records[child.name] = append(z.records[child.name], child.key.ToDS(D.SHA256))
+	}
+}
+
+func (z *testZone) rrset(name string, rtype uint16) (rrs []D.RR) {
+	for _, rr := range z.records[name] {
+		if rr.Header().Rrtype == rtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return
+}
+
+// sign returns rrs with their RRSIG, or as they are if z is insecure.
+func (z *testZone) sign(rrs ...D.RR) []D.RR {
+	z.t.Helper()
+	if z.key == nil || len(rrs) == 0 {
+		return rrs
+	}
+	now := time.Now()
+	inception, expiration := now.Add(-time.Hour), now.Add(time.Hour)
+	if z.expired && rrs[0].Header().Rrtype != D.TypeDNSKEY {
+		inception, expiration = now.Add(-48*time.Hour), now.Add(-24*time.Hour)
+	}
+	return append(append([]D.RR(nil), rrs...), signRRset(z.t, z.key, z.priv, inception, expiration, rrs))
+}
+
+func signRRset(t *testing.T, key *D.DNSKEY, priv crypto.Signer, inception, expiration time.Time, rrs []D.RR) *D.RRSIG {
+	t.Helper()
+	h := rrs[0].Header()
+	sig := &D.RRSIG{
+		Hdr:        D.RR_Header{Name: h.Name, Rrtype: D.TypeRRSIG, Class: D.ClassINET, Ttl: h.Ttl},
+		KeyTag:     key.KeyTag(),
+		SignerName: key.Hdr.Name,
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// isCut reports whether name is a delegation of z.
+func (z *testZone) isCut(name string) bool {
+	return name != z.name && z.rrset(name, D.TypeNS) != nil
+}
+
+// exists reports whether name has records in z, or names below it.
+func (z *testZone) exists(name string) bool {
+	for owner := range z.records {
+		if D.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// owners returns the names of z in the canonical order, with the empty
+// non-terminals if withENT is set.
+func (z *testZone) owners(withENT bool) []string {
+	seen := make(map[string]bool)
+	for owner := range z.records {
+		for name := owner; ; name = parent(name) {
+			seen[name] = true
+			if name == z.name || !withENT {
+				break
+			}
+		}
+	}
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalCompare(names[i], names[j]) < 0 })
+	return names
+}
+
+func (z *testZone) bitmap(name string) (types []uint16) {
+	for _, rr := range z.records[name] {
+		types = append(types, rr.Header().Rrtype)
+	}
+	// the RRsets but the NS of an insecure delegation are signed
+	if len(types) > 0 && (!z.isCut(name) || z.rrset(name, D.TypeDS) != nil) {
+		types = append(types, D.TypeRRSIG)
+	}
+	if !z.nsec3 {
+		types = append(types, D.TypeNSEC, D.TypeRRSIG)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	ret := types[:0]
+	for i, t := range types {
+		if i == 0 || t != types[i-1] {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+// nsec returns the NSEC of the name of z at or before name.
+func (z *testZone) nsec(name string) D.RR {
+	owners := z.owners(false)
+	i := sort.Search(len(owners), func(i int) bool { return canonicalCompare(owners[i], name) > 0 }) - 1
+	return &D.NSEC{
+		Hdr:        D.RR_Header{Name: owners[i], Rrtype: D.TypeNSEC, Class: D.ClassINET, Ttl: 300},
+		NextDomain: owners[(i+1)%len(owners)],
+		TypeBitMap: z.bitmap(owners[i]),
+	}
+}
+
+func hash3(name string) string {
+	return D.HashName(name, D.SHA1, 0, "")
+}
+
+// chain returns the names of the NSEC3 chain of z sorted by their hashes,
+// without the insecure delegations if z is opt-out.
+func (z *testZone) chain() []string {
+	var names []string
+	for _, name := range z.owners(true) {
+		if z.optOut && z.isCut(name) && z.rrset(name, D.TypeDS) == nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return hash3(names[i]) < hash3(names[j]) })
+	return names
+}
+
+// nsec3Of returns the NSEC3 of z matching or covering name.
+func (z *testZone) nsec3Of(name string) D.RR {
+	names := z.chain()
+	h := hash3(name)
+	i := sort.Search(len(names), func(i int) bool { return hash3(names[i]) > h }) - 1
+	if i < 0 {
+		i = len(names) - 1
+	}
+	n := &D.NSEC3{
+		Hdr:        D.RR_Header{Name: strings.ToLower(hash3(names[i])) + "." + z.name, Rrtype: D.TypeNSEC3, Class: D.ClassINET, Ttl: 300},
+		Hash:       D.SHA1,
+		HashLength: 20,
+		NextDomain: hash3(names[(i+1)%len(names)]),
+		TypeBitMap: z.bitmap(names[i]),
+	}
+	if z.optOut {
+		n.Flags = 1
+	}
+	return n
+}
+
+// inChain reports whether name has an NSEC3 of its own.
+func (z *testZone) inChain(name string) bool {
+	for _, n := range z.chain() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// encloser returns the closest encloser of name in z.
+func (z *testZone) encloser(name string) string {
+	for name = parent(name); !z.inChain(name) && !z.exists(name); name = parent(name) {
+	}
+	return name
+}
+
+// deny returns the signed NSEC or NSEC3 records matching or covering names.
+func (z *testZone) deny(names ...string) (rrs []D.RR) {
+	if z.key == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		var rr D.RR
+		if z.nsec3 {
+			rr = z.nsec3Of(name)
+		} else {
+			rr = z.nsec(name)
+		}
+		if !seen[rr.Header().Name] {
+			seen[rr.Header().Name] = true
+			rrs = append(rrs, z.sign(rr)...)
+		}
+	}
+	return
+}
+
+// answer answers m from z like an authoritative server.
+func (z *testZone) answer(m *D.Msg) *D.Msg {
+	q := m.Question[0]
+	name := D.CanonicalName(q.Name)
+	msg := new(D.Msg)
+	msg.SetReply(m)
+	msg.Authoritative = true
+
+	if rrs := z.rrset(name, q.Qtype); rrs != nil {
+		msg.Answer = z.sign(rrs...)
+		return msg
+	}
+
+	soa := z.sign(z.rrset(z.name, D.TypeSOA)...)
+	if z.exists(name) {
+		msg.Ns = soa
+		if z.nsec3 && !z.inChain(name) {
+			// in an opt-out span, the closest encloser proof
+			ce := z.encloser(name)
+			msg.Ns = append(msg.Ns, z.deny(ce, nextCloser(name, ce))...)
+		} else {
+			msg.Ns = append(msg.Ns, z.deny(name)...)
+		}
+		return msg
+	}
+
+	ce := z.encloser(name)
+	wildcard := wildcardOf(ce)
+	if rrs := z.rrset(wildcard, q.Qtype); rrs != nil {
+		for _, rr := range z.sign(rrs...) {
+			rr = D.Copy(rr)
+			rr.Header().Name = q.Name
+			msg.Answer = append(msg.Answer, rr)
+		}
+		if z.nsec3 {
+			msg.Ns = z.deny(nextCloser(name, ce))
+		} else {
+			msg.Ns = z.deny(name)
+		}
+		return msg
+	}
+
+	msg.Ns = soa
+	if !z.exists(wildcard) {
+		msg.Rcode = D.RcodeNameError
+	}
+	if z.nsec3 {
+		msg.Ns = append(msg.Ns, z.deny(ce, nextCloser(name, ce), wildcard)...)
+	} else {
+		msg.Ns = append(msg.Ns, z.deny(name, wildcard)...)
+	}
+	return msg
+}
+
+// testUpstream is a recursive resolver answering from the zones, the
+// DS of a zone from its parent zone.
+type testUpstream struct {
+	zones []*testZone
+	// tamper replaces the answer to m if set
+	tamper func(m, msg *D.Msg) *D.Msg
+}
+
+func (u *testUpstream) zone(name string) *testZone {
+	for _, z := range u.zones {
+		if z.name == name {
+			return z
+		}
+	}
+	return nil
+}
+
+func (u *testUpstream) answer(m *D.Msg) *D.Msg {
+	q := m.Question[0]
+	name := D.CanonicalName(q.Name)
+	var zone *testZone
+	for _, z := range u.zones {
+		if !D.IsSubDomain(z.name, name) || q.Qtype == D.TypeDS && z.name == name && name != "." {
+			continue
+		}
+		if zone == nil || D.CountLabel(z.name) > D.CountLabel(zone.name) {
+			zone = z
+		}
+	}
+	msg := zone.answer(m)
+	if u.tamper != nil {
+		msg = u.tamper(m, msg)
+	}
+	return msg
+}
+
+// newTestUpstream returns the zones of the tests:
+//
+//	.                      NSEC
+//	test.                  NSEC
+//	example.test.          NSEC
+//	nsec3.test.            NSEC3, with the signed sub.nsec3.test.
+//	optout.test.           NSEC3 opt-out, with the unsigned unsigned.optout.test.
+//	insecure.test.         unsigned
+//	expired.test.          NSEC, the RRSIGs of the records expired
+func newTestUpstream(t *testing.T) *testUpstream {
+	records := func(name string) []string {
+		return []string{
+			"www." + name + " 300 IN A 192.0.2.1",
+			"a.b." + name + " 300 IN A 192.0.2.2",
+			"*.wild." + name + " 300 IN A 192.0.2.3",
+		}
+	}
+	root := newTestZone(t, ".", true)
+	tld := newTestZone(t, "test.", true)
+	example := newTestZone(t, "example.test.", true, records("example.test.")...)
+	nsec3 := newTestZone(t, "nsec3.test.", true, records("nsec3.test.")...)
+	nsec3.nsec3 = true
+	sub := newTestZone(t, "sub.nsec3.test.", true, records("sub.nsec3.test.")...)
+	optOut := newTestZone(t, "optout.test.", true, records("optout.test.")...)
+	optOut.nsec3, optOut.optOut = true, true
+	unsigned := newTestZone(t, "unsigned.optout.test.", false, records("unsigned.optout.test.")...)
+	insecure := newTestZone(t, "insecure.test.", false, records("insecure.test.")...)
+	expired := newTestZone(t, "expired.test.", true, records("expired.test.")...)
+	expired.expired = true
+
+	root.delegate(tld)
+	for _, z := range []*testZone{example, nsec3, optOut, insecure, expired} {
+		tld.delegate(z)
+	}
+	nsec3.delegate(sub)
+	optOut.delegate(unsigned)
+	return &testUpstream{zones: []*testZone{root, tld, example, nsec3, sub, optOut, unsigned, insecure, expired}}
+}
+
+// newTestValidator returns a resolver validating the answers of u, with
+// the key of its root as the trust anchor.
+func newTestValidator(t *testing.T, u *testUpstream) *Resolver {
+	t.Helper()
+	r := &Resolver{StrategyFun: func(m *D.Msg, _ *Resolver) (*D.Msg, error) {
+		return u.answer(m), nil
+	}}
+	v, err := newValidator(r, &DNSSECConfig{TrustAnchors: []string{u.zone(".").key.ToDS(D.SHA256).String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.validator = v
+	return r
+}
+
+// replay answers the A query of name with the denial of the zone for
+// the names, which isn't the zone of name.
+func replay(u *testUpstream, name, zone string, rcode int, names ...string) func(m, msg *D.Msg) *D.Msg {
+	return func(m, msg *D.Msg) *D.Msg {
+		if q := m.Question[0]; D.CanonicalName(q.Name) != name || q.Qtype != D.TypeA {
+			return msg
+		}
+		z := u.zone(zone)
+		ret := new(D.Msg)
+		ret.SetRcode(m, rcode)
+		ret.Ns = append(z.sign(z.rrset(z.name, D.TypeSOA)...), z.deny(names...)...)
+		return ret
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		tamper func(u *testUpstream) func(m, msg *D.Msg) *D.Msg
+		rcode  int
+		ad     bool
+		// ede is the code of the error, none if 0
+		ede uint16
+	}{
+		{name: "secure", qname: "www.example.test.", qtype: D.TypeA, ad: true},
+		{name: "secure keys", qname: "example.test.", qtype: D.TypeDNSKEY, ad: true},
+		{name: "nsec nxdomain", qname: "nx.example.test.", qtype: D.TypeA, rcode: D.RcodeNameError, ad: true},
+		{name: "nsec nodata", qname: "www.example.test.", qtype: D.TypeTXT, ad: true},
+		{name: "nsec empty non-terminal", qname: "b.example.test.", qtype: D.TypeA, ad: true},
+		{name: "nsec wildcard", qname: "x.wild.example.test.", qtype: D.TypeA, ad: true},
+		{name: "nsec wildcard nodata", qname: "x.wild.example.test.", qtype: D.TypeTXT, ad: true},
+		{name: "nsec ds nodata", qname: "www.example.test.", qtype: D.TypeDS, ad: true},
+		{name: "nsec3 secure", qname: "www.nsec3.test.", qtype: D.TypeA, ad: true},
+		{name: "nsec3 nxdomain", qname: "nx.nsec3.test.", qtype: D.TypeA, rcode: D.RcodeNameError, ad: true},
+		{name: "nsec3 nodata", qname: "www.nsec3.test.", qtype: D.TypeTXT, ad: true},
+		{name: "nsec3 empty non-terminal", qname: "b.nsec3.test.", qtype: D.TypeA, ad: true},
+		{name: "nsec3 wildcard", qname: "x.wild.nsec3.test.", qtype: D.TypeA, ad: true},
+		{name: "nsec3 wildcard nodata", qname: "x.wild.nsec3.test.", qtype: D.TypeTXT, ad: true},
+		{name: "nsec3 child zone", qname: "www.sub.nsec3.test.", qtype: D.TypeA, ad: true},
+		{name: "insecure", qname: "www.insecure.test.", qtype: D.TypeA},
+		{name: "insecure nxdomain", qname: "nx.insecure.test.", qtype: D.TypeA, rcode: D.RcodeNameError},
+		{name: "opt-out secure", qname: "www.optout.test.", qtype: D.TypeA, ad: true},
+		{name: "opt-out unsigned delegation", qname: "www.unsigned.optout.test.", qtype: D.TypeA},
+		{name: "opt-out ds nodata", qname: "unsigned.optout.test.", qtype: D.TypeDS},
+		{name: "opt-out nxdomain", qname: "nx.optout.test.", qtype: D.TypeA, rcode: D.RcodeNameError},
+		{name: "expired", qname: "www.expired.test.", qtype: D.TypeA, ede: D.ExtendedErrorCodeSignatureExpired},
+		{
+			name: "bogus record", qname: "www.example.test.", qtype: D.TypeA, ede: D.ExtendedErrorCodeDNSBogus,
+			tamper: func(*testUpstream) func(m, msg *D.Msg) *D.Msg {
+				return func(m, msg *D.Msg) *D.Msg {
+					if m.Question[0].Qtype == D.TypeA {
+						msg.Answer[0].(*D.A).A = []byte{192, 0, 2, 99}
+					}
+					return msg
+				}
+			},
+		},
+		{
+			name: "bogus no RRSIG", qname: "www.example.test.", qtype: D.TypeA, ede: D.ExtendedErrorCodeRRSIGsMissing,
+			tamper: func(*testUpstream) func(m, msg *D.Msg) *D.Msg {
+				return func(m, msg *D.Msg) *D.Msg {
+					if m.Question[0].Qtype == D.TypeA {
+						msg.Answer = msg.Answer[:1]
+					}
+					return msg
+				}
+			},
+		},
+		{
+			name: "bogus no NSEC", qname: "nx.example.test.", qtype: D.TypeA, ede: D.ExtendedErrorCodeNSECMissing,
+			tamper: func(*testUpstream) func(m, msg *D.Msg) *D.Msg {
+				return func(m, msg *D.Msg) *D.Msg {
+					if m.Question[0].Qtype == D.TypeA {
+						msg.Ns = msg.Ns[:2]
+					}
+					return msg
+				}
+			},
+		},
+		{
+			name: "parent nsec nxdomain", qname: "www.example.test.", qtype: D.TypeA, ede: D.ExtendedErrorCodeDNSBogus,
+			tamper: func(u *testUpstream) func(m, msg *D.Msg) *D.Msg {
+				return replay(u, "www.example.test.", "test.", D.RcodeNameError, "www.example.test.", "*.example.test.")
+			},
+		},
+		{
+			name: "parent nsec nodata", qname: "example.test.", qtype: D.TypeA, ede: D.ExtendedErrorCodeDNSBogus,
+			tamper: func(u *testUpstream) func(m, msg *D.Msg) *D.Msg {
+				return replay(u, "example.test.", "test.", D.RcodeSuccess, "example.test.")
+			},
+		},
+		{
+			name: "parent nsec3 nxdomain", qname: "www.sub.nsec3.test.", qtype: D.TypeA, ede: D.ExtendedErrorCodeDNSBogus,
+			tamper: func(u *testUpstream) func(m, msg *D.Msg) *D.Msg {
+				return replay(u, "www.sub.nsec3.test.", "nsec3.test.", D.RcodeNameError,
+					"sub.nsec3.test.", "www.sub.nsec3.test.", "*.sub.nsec3.test.")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUpstream(t)
+			if tt.tamper != nil {
+				u.tamper = tt.tamper(u)
+			}
+			r := newTestValidator(t, u)
+
+			m := new(D.Msg)
+			m.SetQuestion(tt.qname, tt.qtype)
+			m.SetEdns0(4096, true)
+			msg, err := r.Exchange(m)
+			if tt.ede != 0 {
+				var e *ExtendedError
+				if !errors.As(err, &e) || e.Code != tt.ede {
+					t.Fatalf("got error %v, want %s", err, D.ExtendedErrorCodeToString[tt.ede])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Rcode != tt.rcode || msg.AuthenticatedData != tt.ad {
+				t.Errorf("got %s AD=%t, want %s AD=%t", D.RcodeToString[msg.Rcode], msg.AuthenticatedData,
+					D.RcodeToString[tt.rcode], tt.ad)
+			}
+		})
+	}
+}
+
+func TestDenyDelegation(t *testing.T) {
+	// the NSEC and NSEC3 of example.test. in its parent zone, and of the
+	// apex and the insecure delegation of the zone
+	nsec := &D.NSEC{
+		Hdr:        D.RR_Header{Name: "example.test.", Rrtype: D.TypeNSEC, Class: D.ClassINET},
+		NextDomain: "insecure.test.",
+		TypeBitMap: []uint16{D.TypeNS, D.TypeDS, D.TypeRRSIG, D.TypeNSEC},
+	}
+	apex := &D.NSEC{
+		Hdr:        D.RR_Header{Name: "test.", Rrtype: D.TypeNSEC, Class: D.ClassINET},
+		NextDomain: "example.test.",
+		TypeBitMap: []uint16{D.TypeNS, D.TypeSOA, D.TypeRRSIG, D.TypeNSEC, D.TypeDNSKEY},
+	}
+	insecure := &D.NSEC{
+		Hdr:        D.RR_Header{Name: "insecure.test.", Rrtype: D.TypeNSEC, Class: D.ClassINET},
+		NextDomain: "test.",
+		TypeBitMap: []uint16{D.TypeNS, D.TypeRRSIG, D.TypeNSEC},
+	}
+	z := &testZone{name: "test.", nsec3: true, records: map[string][]D.RR{}}
+	z.records["example.test."] = []D.RR{&D.NS{Hdr: D.RR_Header{Name: "example.test.", Rrtype: D.TypeNS}}}
+	nsec3 := z.nsec3Of("example.test.").(*D.NSEC3)
+	chain := []*D.NSEC3{z.nsec3Of("test.").(*D.NSEC3), nsec3}
+
+	tests := []struct {
+		name   string
+		nsecs  []*D.NSEC
+		nsec3s []*D.NSEC3
+		qname  string
+		qtype  uint16
+		ok     bool
+	}{
+		{name: "nsec name below", nsecs: []*D.NSEC{nsec}, qname: "www.example.test."},
+		{name: "nsec type", nsecs: []*D.NSEC{nsec}, qname: "example.test.", qtype: D.TypeA},
+		{name: "nsec ds", nsecs: []*D.NSEC{insecure}, qname: "insecure.test.", qtype: D.TypeDS, ok: true},
+		{name: "nsec name after", nsecs: []*D.NSEC{apex, nsec}, qname: "f.test.", ok: true},
+		{name: "nsec3 name below", nsec3s: chain, qname: "www.example.test."},
+		{name: "nsec3 type", nsec3s: []*D.NSEC3{nsec3}, qname: "example.test.", qtype: D.TypeA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.qtype == 0 {
+				_, err = denyName(tt.nsecs, tt.nsec3s, tt.qname)
+			} else {
+				_, err = denyType(tt.nsecs, tt.nsec3s, tt.qname, tt.qtype)
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok=%t", err, tt.ok)
+			}
+		})
+	}
+}
+
+// rootKey is a KSK of the root for the trust anchor tests.
+type rootKey struct {
+	key  *D.DNSKEY
+	priv crypto.Signer
+}
+
+func newRootKey(t *testing.T) *rootKey {
+	t.Helper()
+	k := &D.DNSKEY{
+		Hdr:   D.RR_Header{Name: ".", Rrtype: D.TypeDNSKEY, Class: D.ClassINET, Ttl: 3600},
+		Flags: D.ZONE | D.SEP, Protocol: 3, Algorithm: D.ECDSAP256SHA256,
+	}
+	priv, err := k.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &rootKey{key: k, priv: priv.(crypto.Signer)}
+}
+
+// revoked returns the key with the REVOKE flag.
+func (k *rootKey) revoked() *rootKey {
+	r := *k.key
+	r.Flags |= D.REVOKE
+	return &rootKey{key: &r, priv: k.priv}
+}
+
+// rootSet returns the DNSKEY RRset of the keys signed by the signers.
+func rootSet(t *testing.T, keys []*rootKey, signers ...*rootKey) *rrset {
+	t.Helper()
+	set := &rrset{name: ".", rtype: D.TypeDNSKEY}
+	for _, k := range keys {
+		set.rrs = append(set.rrs, k.key)
+	}
+	now := time.Now()
+	for _, s := range signers {
+		set.sigs = append(set.sigs, signRRset(t, s.key, s.priv, now.Add(-time.Hour), now.Add(time.Hour), set.rrs))
+	}
+	return set
+}
+
+func TestTrustAnchorsUpdate(t *testing.T) {
+	old, added := newRootKey(t), newRootKey(t)
+	stateOf := func(anchors *trustAnchors, k *rootKey) string {
+		for _, a := range anchors.anchors {
+			if anchorMatches(a.rr, k.key) {
+				return a.state
+			}
+		}
+		return ""
+	}
+	// since sets the time the added key was first seen
+	since := func(anchors *trustAnchors, k *rootKey, ago time.Duration) {
+		for _, a := range anchors.anchors {
+			if anchorMatches(a.rr, k.key) {
+				a.since = time.Now().Add(-ago)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		// steps are the DNSKEY RRsets seen in order, with the time the
+		// added key was first seen moved back before each
+		steps []func(*trustAnchors) *rrset
+		old   string
+		added string
+	}{
+		{
+			name:  "add pending",
+			steps: []func(*trustAnchors) *rrset{func(*trustAnchors) *rrset { return rootSet(t, []*rootKey{old, added}, old) }},
+			old:   anchorValid, added: anchorPending,
+		},
+		{
+			name: "hold-down",
+			steps: []func(*trustAnchors) *rrset{
+				func(*trustAnchors) *rrset { return rootSet(t, []*rootKey{old, added}, old) },
+				func(a *trustAnchors) *rrset {
+					since(a, added, addHoldDown-time.Hour)
+					return rootSet(t, []*rootKey{old, added}, old)
+				},
+			},
+			old: anchorValid, added: anchorPending,
+		},
+		{
+			name: "hold-down passed",
+			steps: []func(*trustAnchors) *rrset{
+				func(*trustAnchors) *rrset { return rootSet(t, []*rootKey{old, added}, old) },
+				func(a *trustAnchors) *rrset {
+					since(a, added, addHoldDown+time.Hour)
+					return rootSet(t, []*rootKey{old, added}, old)
+				},
+			},
+			old: anchorValid, added: anchorValid,
+		},
+		{
+			name: "pending removed",
+			steps: []func(*trustAnchors) *rrset{
+				func(*trustAnchors) *rrset { return rootSet(t, []*rootKey{old, added}, old) },
+				func(*trustAnchors) *rrset { return rootSet(t, []*rootKey{old}, old) },
+			},
+			old: anchorValid,
+		},
+		{
+			name: "revoked",
+			steps: []func(*trustAnchors) *rrset{func(*trustAnchors) *rrset {
+				return rootSet(t, []*rootKey{old.revoked(), added}, old.revoked())
+			}},
+			added: anchorPending,
+		},
+		{
+			name: "revoked by another key",
+			steps: []func(*trustAnchors) *rrset{func(*trustAnchors) *rrset {
+				return rootSet(t, []*rootKey{old.revoked(), added}, added)
+			}},
+			old: anchorValid, added: anchorPending,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "root.key")
+			config := &DNSSECConfig{TrustAnchors: []string{old.key.ToDS(D.SHA256).String()}, TrustAnchorFile: file}
+			anchors, err := newTrustAnchors(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range tt.steps {
+				anchors.update(step(anchors))
+			}
+			if s := stateOf(anchors, old); s != tt.old {
+				t.Errorf("old key %q, want %q", s, tt.old)
+			}
+			if s := stateOf(anchors, added); s != tt.added {
+				t.Errorf("added key %q, want %q", s, tt.added)
+			}
+
+			// the states are kept in the file
+			loaded, err := newTrustAnchors(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stateOf(loaded, old) != tt.old || stateOf(loaded, added) != tt.added {
+				t.Error("states not saved in the file")
+			}
+
+			// only the valid keys are trusted
+			trusted := anchors.trusted([]D.RR{old.key, added.key})
+			if want := countValid(tt.old, tt.added); len(trusted) != want {
+				t.Errorf("%d keys trusted, want %d", len(trusted), want)
+			}
+		})
+	}
+}
+
+func countValid(states ...string) (n int) {
+	for _, s := range states {
+		if s == anchorValid {
+			n++
+		}
+	}
+	return
+}
+
+func TestValidateAD(t *testing.T) {
+	u := newTestUpstream(t)
+	r := newTestValidator(t, u)
+	cache, err := LEC.New(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.lruExpiresCache = cache
+
+	// in an order where a cached answer with AD would be reused
+	tests := []struct {
+		name   string
+		do, ad bool
+		want   bool
+	}{
+		{name: "ad", ad: true, want: true},
+		{name: "neither"},
+		{name: "do", do: true, want: true},
+		{name: "do again", do: true, want: true},
+		{name: "ad again", ad: true, want: true},
+		{name: "neither again"},
+	}
+	for _, tt := range tests {
+		m := new(D.Msg)
+		m.SetQuestion("www.example.test.", D.TypeA)
+		m.AuthenticatedData = tt.ad
+		m.SetEdns0(4096, tt.do)
+		msg, err := r.Exchange(m)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if msg.AuthenticatedData != tt.want {
+			t.Errorf("%s: AD %t, want %t", tt.name, msg.AuthenticatedData, tt.want)
+		}
+		if hasSig := len(msg.Answer) > 1; hasSig != tt.do {
+			t.Errorf("%s: %d records in the answer", tt.name, len(msg.Answer))
+		}
+	}
+}
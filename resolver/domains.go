@@ -0,0 +1,76 @@
+package resolver
+
+import (
+	"errors"
+
+	D "github.com/miekg/dns"
+)
+
+// setDomainResolvers moves the upstreams only serving some domains to
+// their own resolvers, the other upstreams serve the rest of the names.
+func (r *Resolver) setDomainResolvers(config *Config) (clientsConfig []*ClientConfig, err error) {
+	groups := make(map[string][]*ClientConfig)
+	for _, c := range config.ClientsConfig {
+		if len(c.Domains) == 0 {
+			clientsConfig = append(clientsConfig, c)
+			continue
+		}
+		for _, domain := range c.Domains {
+			domain = D.CanonicalName(domain)
+			groups[domain] = append(groups[domain], c)
+		}
+	}
+	if len(groups) == 0 {
+		return clientsConfig, nil
+	}
+	// the names out of the domains need an upstream
+	if len(clientsConfig) == 0 {
+		return nil, errors.New("no upstream without domains for the other names")
+	}
+
+	r.domainResolvers = make(map[string]*Resolver)
+	for domain, group := range groups {
+		r.domainResolvers[domain], err = NewResolver(&Config{
+			ClientsConfig: withoutDomains(group),
+			Strategy:      config.Strategy,
+			MaxRetries:    config.MaxRetries,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return clientsConfig, nil
+}
+
+func withoutDomains(clientsConfig []*ClientConfig) (ret []*ClientConfig) {
+	for _, c := range clientsConfig {
+		copied := *c
+		copied.Domains = nil
+		ret = append(ret, &copied)
+	}
+	return
+}
+
+// route returns the resolver of the upstreams for name, the one of the
+// longest matching domain, or r itself.
+func (r *Resolver) route(name string) *Resolver {
+	if r.domainResolvers == nil {
+		return r
+	}
+	name = D.CanonicalName(name)
+	for {
+		if sub, ok := r.domainResolvers[name]; ok {
+			return sub
+		}
+		if name == "." {
+			return r
+		}
+		name = parent(name)
+	}
+}
+
+// strategy sends m to the upstreams of its name with their strategy.
+func (r *Resolver) strategy(m *D.Msg) (*D.Msg, error) {
+	sub := r.route(m.Question[0].Name)
+	return sub.StrategyFun(m, sub)
+}
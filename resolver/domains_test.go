@@ -0,0 +1,25 @@
+package resolver
+
+import "testing"
+
+func TestSetDomainResolvers(t *testing.T) {
+	lan := &ClientConfig{URL: "udp://192.0.2.1:53", Domains: []string{"lan"}}
+	other := &ClientConfig{URL: "udp://192.0.2.2:53"}
+
+	r := new(Resolver)
+	if _, err := r.setDomainResolvers(&Config{ClientsConfig: []*ClientConfig{lan}}); err == nil {
+		t.Error("no error without an upstream for the other names")
+	}
+
+	r = new(Resolver)
+	clients, err := r.setDomainResolvers(&Config{ClientsConfig: []*ClientConfig{lan, other}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0] != other {
+		t.Errorf("got upstreams %v, want the one without domains", clients)
+	}
+	if r.route("host.lan.") == r || r.route("example.org.") != r {
+		t.Error("names routed to the wrong upstreams")
+	}
+}
@@ -0,0 +1,238 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+
+	D "github.com/miekg/dns"
+)
+
+// Modes of EDNS Client Subnet (RFC 7871)
+const (
+	// ECSPassthrough forwards the ECS option of the client
+	ECSPassthrough = "passthrough"
+	// ECSSynthesize adds the subnet of the client address,
+	// unless the client has sent its own option
+	ECSSynthesize = "synthesize"
+	// ECSFixed sends the same subnet for all clients
+	ECSFixed = "fixed"
+	// ECSStrip never sends ECS to the upstreams
+	ECSStrip = "strip"
+)
+
+const (
+	defaultECSIPv4Prefix = 24
+	defaultECSIPv6Prefix = 56
+)
+
+type ECSConfig struct {
+	// Mode is one of the ECS modes, ECSPassthrough if empty
+	Mode string
+	// IPv4Prefix and IPv6Prefix are the longest source prefixes sent,
+	// 24 and 56 if 0
+	IPv4Prefix uint8
+	IPv6Prefix uint8
+	// Subnet is the subnet of ECSFixed, like 203.0.113.0/24
+	Subnet string
+}
+
+type ecsPolicy struct {
+	mode   string
+	v4, v6 uint8
+	fixed  *D.EDNS0_SUBNET
+}
+
+func newECSPolicy(config *ECSConfig) (*ecsPolicy, error) {
+	p := &ecsPolicy{mode: ECSPassthrough, v4: defaultECSIPv4Prefix, v6: defaultECSIPv6Prefix}
+	if config == nil {
+		return p, nil
+	}
+
+	if config.IPv4Prefix > 32 || config.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid ECS prefix /%d or /%d", config.IPv4Prefix, config.IPv6Prefix)
+	}
+	if config.IPv4Prefix != 0 {
+		p.v4 = config.IPv4Prefix
+	}
+	if config.IPv6Prefix != 0 {
+		p.v6 = config.IPv6Prefix
+	}
+
+	switch config.Mode {
+	case "", ECSPassthrough:
+	case ECSSynthesize, ECSStrip:
+		p.mode = config.Mode
+	case ECSFixed:
+		p.mode = config.Mode
+		_, subnet, err := net.ParseCIDR(config.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ECS subnet: %w", err)
+		}
+		ones, _ := subnet.Mask.Size()
+		p.fixed = newSubnet(subnet.IP, uint8(ones))
+	default:
+		return nil, fmt.Errorf("invalid ECS mode: %s", config.Mode)
+	}
+	return p, nil
+}
+
+// newSubnet returns the ECS option of ip masked to prefix.
+func newSubnet(ip net.IP, prefix uint8) *D.EDNS0_SUBNET {
+	e := &D.EDNS0_SUBNET{Code: D.EDNS0SUBNET, SourceNetmask: prefix}
+	if ip4 := ip.To4(); ip4 != nil {
+		e.Family = 1
+		if prefix > 32 {
+			e.SourceNetmask = 32
+		}
+		e.Address = ip4.Mask(net.CIDRMask(int(e.SourceNetmask), 32))
+	} else {
+		e.Family = 2
+		if prefix > 128 {
+			e.SourceNetmask = 128
+		}
+		e.Address = ip.Mask(net.CIDRMask(int(e.SourceNetmask), 128))
+	}
+	return e
+}
+
+// getECS returns the ECS option of m, or nil if there isn't one.
+func getECS(m *D.Msg) *D.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*D.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// setECS replaces the ECS option of m with ecs, or removes it if ecs is nil.
+func setECS(m *D.Msg, ecs *D.EDNS0_SUBNET) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		if ecs == nil {
+			return
+		}
+		m.SetEdns0(D.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+
+	options := opt.Option[:0:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*D.EDNS0_SUBNET); !ok {
+			options = append(options, o)
+		}
+	}
+	if ecs != nil {
+		options = append(options, ecs)
+	}
+	opt.Option = options
+}
+
+// subnet returns the ECS option sent to the upstreams for the query m
+// from the client at addr, nil for none.
+func (p *ecsPolicy) subnet(m *D.Msg, addr string) *D.EDNS0_SUBNET {
+	if p == nil {
+		return nil
+	}
+
+	client := getECS(m)
+	// a source prefix of 0 asks not to reveal the client (RFC 7871 section 7.1.2)
+	if client != nil && client.SourceNetmask == 0 {
+		return nil
+	}
+
+	switch p.mode {
+	case ECSStrip:
+		return nil
+	case ECSFixed:
+		return p.fixed
+	case ECSSynthesize:
+		if client != nil {
+			return p.truncate(client)
+		}
+		ip := hostIP(addr)
+		// the private addresses mean nothing to the upstreams
+		if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			return nil
+		}
+		if ip.To4() != nil {
+			return newSubnet(ip, p.v4)
+		}
+		return newSubnet(ip, p.v6)
+	default:
+		if client == nil {
+			return nil
+		}
+		return p.truncate(client)
+	}
+}
+
+// truncate shortens the source prefix of the client option to the
+// configured one.
+func (p *ecsPolicy) truncate(e *D.EDNS0_SUBNET) *D.EDNS0_SUBNET {
+	prefix := e.SourceNetmask
+	switch e.Family {
+	case 1:
+		if prefix > p.v4 {
+			prefix = p.v4
+		}
+	case 2:
+		if prefix > p.v6 {
+			prefix = p.v6
+		}
+	default:
+		return nil
+	}
+	return newSubnet(e.Address, prefix)
+}
+
+// ecsScope returns the scope prefix of the response to a query sent with
+// ecs, which can't be longer than the source prefix (RFC 7871 section 7.3.1).
+func ecsScope(msg *D.Msg, ecs *D.EDNS0_SUBNET) uint8 {
+	if ecs == nil || msg == nil {
+		return 0
+	}
+	e := getECS(msg)
+	// an upstream without ECS support answers for everyone
+	if e == nil {
+		return 0
+	}
+	if e.SourceScope > ecs.SourceNetmask {
+		return ecs.SourceNetmask
+	}
+	return e.SourceScope
+}
+
+// ecsCacheKey returns the cache key of the answer for the clients in
+// the subnet of ecs masked to prefix. The answers to the queries without
+// ECS are tailored to the address of leedns, so they are kept apart
+// from the answers of scope 0.
+func ecsCacheKey(key string, ecs *D.EDNS0_SUBNET, prefix uint8) string {
+	if ecs == nil {
+		return key
+	}
+	return fmt.Sprintf("%s %s/%d", key, newSubnet(ecs.Address, prefix).Address, prefix)
+}
+
+// replyECS sets the ECS option of the response to the client, which
+// only has one if the client has sent one.
+func replyECS(msg, m *D.Msg, scope uint8) {
+	if msg == nil {
+		return
+	}
+	client := getECS(m)
+	if client == nil {
+		setECS(msg, nil)
+		return
+	}
+	e := *client
+	e.SourceScope = scope
+	if e.SourceScope > e.SourceNetmask {
+		e.SourceScope = e.SourceNetmask
+	}
+	setECS(msg, &e)
+}
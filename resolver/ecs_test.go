@@ -0,0 +1,87 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+
+	LEC "github.com/zekexy/leedns/cache"
+	D "github.com/miekg/dns"
+)
+
+func TestECSCache(t *testing.T) {
+	// the upstream answers for the /16 of the subnet sent, and for every
+	// client with scope 0 to global.example.
+	var queries int
+	strategy := func(m *D.Msg, _ *Resolver) (*D.Msg, error) {
+		queries++
+		msg := new(D.Msg)
+		msg.SetReply(m)
+		rr, _ := D.NewRR(m.Question[0].Name + " 300 IN A 192.0.2.1")
+		msg.Answer = append(msg.Answer, rr)
+		msg.SetEdns0(4096, false)
+		if e := getECS(m); e != nil {
+			reply := *e
+			if m.Question[0].Name != "global.example." {
+				reply.SourceScope = 16
+			}
+			setECS(msg, &reply)
+		}
+		return msg, nil
+	}
+	ecs, err := newECSPolicy(&ECSConfig{Mode: ECSSynthesize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := LEC.New(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Resolver{StrategyFun: strategy, ecs: ecs, lruExpiresCache: cache}
+
+	tests := []struct {
+		name  string
+		qname string
+		addr  string
+		// ecs is the option of the client, empty for none
+		ecs    string
+		cached bool
+	}{
+		{name: "first", qname: "www.example.", addr: "203.0.113.5:53"},
+		{name: "same scope", qname: "www.example.", addr: "203.0.200.9:53", cached: true},
+		{name: "other scope", qname: "www.example.", addr: "198.51.100.1:53"},
+		{name: "client option in scope", qname: "www.example.", addr: "192.168.1.1:53", ecs: "203.0.1.0/24", cached: true},
+		// the answers without ECS are for the address of leedns
+		{name: "private client", qname: "www.example.", addr: "192.168.1.1:53"},
+		{name: "private client again", qname: "www.example.", addr: "10.0.0.1:53", cached: true},
+		{name: "scope 0", qname: "global.example.", addr: "203.0.113.5:53"},
+		{name: "scope 0 other subnet", qname: "global.example.", addr: "198.51.100.1:53", cached: true},
+	}
+	for _, tt := range tests {
+		m := new(D.Msg)
+		m.SetQuestion(tt.qname, D.TypeA)
+		if tt.ecs != "" {
+			_, subnet, _ := net.ParseCIDR(tt.ecs)
+			ones, _ := subnet.Mask.Size()
+			m.SetEdns0(4096, false)
+			setECS(m, newSubnet(subnet.IP, uint8(ones)))
+		}
+
+		before := queries
+		msg, err := r.ExchangeFrom(m, tt.addr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if cached := queries == before; cached != tt.cached {
+			t.Errorf("%s: cached %t, want %t", tt.name, cached, tt.cached)
+		}
+
+		// the client gets an option only if it has sent one, with the scope
+		e := getECS(msg)
+		switch {
+		case tt.ecs == "" && e != nil:
+			t.Errorf("%s: option %v sent to a client without one", tt.name, e)
+		case tt.ecs != "" && (e == nil || e.SourceScope != 16):
+			t.Errorf("%s: option %v, want scope 16", tt.name, e)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	D "github.com/miekg/dns"
+)
+
+// ExtendedError is a failure to answer a query, with the extended DNS
+// error (RFC 8914) telling the client why.
+type ExtendedError struct {
+	Code uint16
+	// Text is the EXTRA-TEXT sent to the client, Err is only logged,
+	// as it may reveal the addresses of the upstreams
+	Text string
+	Err  error
+}
+
+func (e *ExtendedError) Error() string {
+	if e.Err == nil {
+		return D.ExtendedErrorCodeToString[e.Code]
+	}
+	return fmt.Sprintf("%s: %s", D.ExtendedErrorCodeToString[e.Code], e.Err.Error())
+}
+
+func (e *ExtendedError) Unwrap() error {
+	return e.Err
+}
+
+// EDE returns the EDE option for the client of err, ExtendedErrorCodeOther if err
+// isn't an ExtendedError.
+func EDE(err error) *D.EDNS0_EDE {
+	var e *ExtendedError
+	if errors.As(err, &e) {
+		return &D.EDNS0_EDE{InfoCode: e.Code, ExtraText: e.Text}
+	}
+	return &D.EDNS0_EDE{InfoCode: D.ExtendedErrorCodeOther}
+}
+
+// GetEDE returns the EDE options of m.
+func GetEDE(m *D.Msg) (edes []*D.EDNS0_EDE) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*D.EDNS0_EDE); ok {
+			edes = append(edes, e)
+		}
+	}
+	return
+}
+
+// addEDE adds the EDE option of code to m, with an OPT record if
+// there isn't one, which is dropped if the client hasn't sent one.
+func addEDE(m *D.Msg, code uint16, text string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(D.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*D.EDNS0_EDE); ok && e.InfoCode == code {
+			return
+		}
+	}
+	opt.Option = append(opt.Option, &D.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// upstreamError returns the error of a query none of the upstreams
+// answered, err is the last error of the upstreams, nil if none was tried.
+// Timeouts and refused connections mean the upstreams are unreachable,
+// the other failures, like a bad certificate, are network errors.
+func upstreamError(err error) error {
+	if err == nil {
+		return &ExtendedError{Code: D.ExtendedErrorCodeNoReachableAuthority, Text: "no upstream available",
+			Err: errors.New("no upstream available")}
+	}
+	var netErr net.Error
+	var opErr *net.OpError
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.As(err, &opErr) && opErr.Op == "dial" ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return &ExtendedError{Code: D.ExtendedErrorCodeNoReachableAuthority, Text: "upstreams unreachable", Err: err}
+	}
+	return &ExtendedError{Code: D.ExtendedErrorCodeNetworkError, Text: "upstreams failed", Err: err}
+}
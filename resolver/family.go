@@ -0,0 +1,175 @@
+package resolver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/zekexy/leedns/dns"
+	D "github.com/miekg/dns"
+)
+
+type AddressFamilyConfig struct {
+	// Mode is the address family mode of the clients in none of the
+	// groups and of the bootstrap addresses, dns.FamilyAny if empty
+	Mode string
+	// Groups are checked in order, the first one of the client applies
+	Groups []*AddressFamilyGroup
+}
+
+type AddressFamilyGroup struct {
+	// Clients are the IPs or subnets of the group
+	Clients []string
+	Mode    string
+}
+
+type familyGroup struct {
+	clients subnets
+	mode    string
+}
+
+type familyPolicy struct {
+	mode   string
+	groups []*familyGroup
+}
+
+func newFamilyPolicy(config *AddressFamilyConfig) (p *familyPolicy, err error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	if err = dns.CheckFamily(config.Mode); err != nil {
+		return nil, err
+	}
+	p = &familyPolicy{mode: config.Mode}
+	for _, g := range config.Groups {
+		if err = dns.CheckFamily(g.Mode); err != nil {
+			return nil, err
+		}
+		if len(g.Clients) == 0 {
+			return nil, fmt.Errorf("address family group of %s has no clients", g.Mode)
+		}
+		clients, err := parseSubnets(g.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address family clients: %w", err)
+		}
+		p.groups = append(p.groups, &familyGroup{clients: clients, mode: g.Mode})
+	}
+	return p, nil
+}
+
+// modeOf returns the address family mode of the client at addr, the
+// queries of leedns itself have an empty addr.
+func (p *familyPolicy) modeOf(addr string) string {
+	if p == nil {
+		return dns.FamilyAny
+	}
+	ip := hostIP(addr)
+	for _, g := range p.groups {
+		if g.clients.contains(ip) {
+			return g.mode
+		}
+	}
+	return p.mode
+}
+
+// hasRecords reports whether msg answers with records of qtype.
+func hasRecords(msg *D.Msg, qtype uint16) bool {
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutRecords returns a copy of msg without the records of qtype and
+// their signatures in the answer, a NODATA answer with the SOA of the zone
+// in the authority section, none if soa is nil.
+func withoutRecords(msg *D.Msg, qtype uint16, soa *D.SOA) *D.Msg {
+	ret := msg.Copy()
+	answer := ret.Answer
+	ret.Answer = nil
+	for _, rr := range answer {
+		if rr.Header().Rrtype == qtype {
+			continue
+		}
+		if sig, ok := rr.(*D.RRSIG); ok && sig.TypeCovered == qtype {
+			continue
+		}
+		ret.Answer = append(ret.Answer, rr)
+	}
+	// the NS records of the positive answer would make it a referral,
+	// the SOA gives the TTL of the negative answer (RFC 2308 section 3)
+	ret.Ns = nil
+	if soa != nil {
+		rr := D.Copy(soa).(*D.SOA)
+		if rr.Minttl < rr.Hdr.Ttl {
+			rr.Hdr.Ttl = rr.Minttl
+		}
+		ret.Ns = append(ret.Ns, rr)
+	}
+	// the answer isn't the validated one any more
+	ret.AuthenticatedData = false
+	return ret
+}
+
+// filterFamily drops the A or AAAA records of msg, the answer to m from
+// the client at addr, by the address family mode of the client. The
+// answers are filtered out of the cache, which keeps the real ones.
+func (r *Resolver) filterFamily(m, msg *D.Msg, addr string) *D.Msg {
+	q := m.Question[0]
+	if msg == nil || msg.Rcode != D.RcodeSuccess || q.Qclass != D.ClassINET {
+		return msg
+	}
+
+	// other is the type of the records kept in place of the ones of q,
+	// 0 to drop them anyway
+	var other uint16
+	switch mode := r.family.modeOf(addr); {
+	case q.Qtype == D.TypeAAAA && mode == dns.IPv4Only, q.Qtype == D.TypeA && mode == dns.IPv6Only:
+	case q.Qtype == D.TypeAAAA && mode == dns.PreferIPv4:
+		other = D.TypeA
+	case q.Qtype == D.TypeA && mode == dns.PreferIPv6:
+		other = D.TypeAAAA
+	default:
+		return msg
+	}
+	if !hasRecords(msg, q.Qtype) {
+		return msg
+	}
+
+	if other != 0 {
+		o := m.Copy()
+		o.Question[0].Qtype = other
+		om, err := r.exchange(o, addr)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		if om == nil || om.Rcode != D.RcodeSuccess || !hasRecords(om, other) {
+			return msg
+		}
+	}
+	return withoutRecords(msg, q.Qtype, r.zoneSOA(m, addr))
+}
+
+// zoneSOA returns the SOA of the zone of the name of m, the one the
+// CNAMEs of the name end in, nil if it isn't found.
+func (r *Resolver) zoneSOA(m *D.Msg, addr string) *D.SOA {
+	s := m.Copy()
+	s.Question[0].Qtype = D.TypeSOA
+	msg, err := r.exchange(s, addr)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	if msg == nil {
+		return nil
+	}
+	for _, rrs := range [][]D.RR{msg.Answer, msg.Ns} {
+		for _, rr := range rrs {
+			if soa, ok := rr.(*D.SOA); ok {
+				return soa
+			}
+		}
+	}
+	return nil
+}
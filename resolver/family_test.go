@@ -0,0 +1,72 @@
+package resolver
+
+import (
+	"testing"
+
+	"github.com/zekexy/leedns/dns"
+	D "github.com/miekg/dns"
+)
+
+func TestFilterFamily(t *testing.T) {
+	records := map[uint16]string{
+		D.TypeA:    "www.example.org. 300 IN A 192.0.2.1",
+		D.TypeAAAA: "www.example.org. 300 IN AAAA 2001:db8::1",
+	}
+	strategy := func(m *D.Msg, _ *Resolver) (*D.Msg, error) {
+		msg := new(D.Msg)
+		msg.SetReply(m)
+		if s, ok := records[m.Question[0].Qtype]; ok {
+			rr, _ := D.NewRR(s)
+			ns, _ := D.NewRR("example.org. 3600 IN NS ns.example.org.")
+			msg.Answer, msg.Ns = []D.RR{rr}, []D.RR{ns}
+			return msg, nil
+		}
+		soa, _ := D.NewRR("example.org. 3600 IN SOA ns.example.org. admin.example.org. 1 3600 600 86400 300")
+		msg.Ns = []D.RR{soa}
+		return msg, nil
+	}
+
+	tests := []struct {
+		mode  string
+		qtype uint16
+		// kept is whether the records are kept, or a NODATA answer
+		kept bool
+	}{
+		{mode: dns.FamilyAny, qtype: D.TypeAAAA, kept: true},
+		{mode: dns.IPv4Only, qtype: D.TypeAAAA},
+		{mode: dns.IPv4Only, qtype: D.TypeA, kept: true},
+		{mode: dns.PreferIPv4, qtype: D.TypeAAAA},
+		{mode: dns.PreferIPv6, qtype: D.TypeA},
+		{mode: dns.IPv6Only, qtype: D.TypeA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+D.TypeToString[tt.qtype], func(t *testing.T) {
+			family, err := newFamilyPolicy(&AddressFamilyConfig{Mode: tt.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &Resolver{StrategyFun: strategy, family: family}
+
+			m := new(D.Msg)
+			m.SetQuestion("www.example.org.", tt.qtype)
+			msg, err := r.Exchange(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := hasRecords(msg, tt.qtype); kept != tt.kept {
+				t.Fatalf("records kept %t, want %t", kept, tt.kept)
+			}
+			if tt.kept {
+				return
+			}
+			// a NODATA answer with the SOA, not a referral
+			if msg.Rcode != D.RcodeSuccess || len(msg.Ns) != 1 {
+				t.Fatalf("got %s with authority %v, want NODATA with the SOA", D.RcodeToString[msg.Rcode], msg.Ns)
+			}
+			soa, ok := msg.Ns[0].(*D.SOA)
+			if !ok || soa.Hdr.Ttl != 300 {
+				t.Errorf("got authority %v, want the SOA with the negative TTL", msg.Ns[0])
+			}
+		})
+	}
+}
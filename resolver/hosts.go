@@ -1,13 +1,15 @@
 package resolver
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 
-	"github.com/fsnotify/fsnotify"
 	D "github.com/miekg/dns"
 )
 
@@ -22,30 +24,77 @@ func loadFileToString(filePath string) (s string, err error) {
 }
 
 func splitByLines(str string) []string {
+	str = strings.Replace(str, "\r\n", "\n", -1)
 	str = strings.Replace(str, "\r", "\n", -1)
 	return strings.Split(str, "\n")
 }
 
-func LoadHosts(hostsFile string) (hosts Hosts, err error) {
-	hosts = make(Hosts)
+// expandHostsPaths returns the hosts files in paths, a directory is
+// expanded to the regular files in it, sorted by name. The missing or
+// unreadable paths are skipped.
+func expandHostsPaths(paths []string) (files []string) {
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			log.Println("Load hosts file error:", err.Error())
+			continue
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(p)
+		if err != nil {
+			log.Println("Load hosts file error:", err.Error())
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, filepath.Join(p, entry.Name()))
+		}
+	}
+	return
+}
+
+// LoadHosts loads and merges the hosts files and directories in order,
+// an entry defined later overrides the earlier one with the same name.
+// The files that can't be read are logged and skipped.
+func LoadHosts(paths ...string) Hosts {
+	hosts := make(Hosts)
+	sources := make(map[string]string)
+	for _, file := range expandHostsPaths(paths) {
+		if err := loadHostsFile(hosts, sources, file); err != nil {
+			log.Println("Load hosts file error:", err.Error())
+		}
+	}
+	return hosts
+}
 
+func loadHostsFile(hosts Hosts, sources map[string]string, hostsFile string) error {
 	hostsString, err := loadFileToString(hostsFile)
 	if err != nil {
-		return hosts, err
+		return err
 	}
 	list := splitByLines(hostsString)
+	// the PTR of the names first appearing in this file
+	ptrs := make(map[string]bool)
 
-	for _, item := range list {
+	for line, item := range list {
 		if match := regexp.MustCompile(`^\s*#`).FindString(item); match != "" {
 			continue
 		}
 
-		item = regexp.MustCompile(`\s+`).ReplaceAllString(item, " ")
+		item = regexp.MustCompile(`\s+`).ReplaceAllString(strings.TrimSpace(item), " ")
 
 		ss := strings.Split(item, " ")
 		if len(ss) <= 1 {
 			continue
 		}
+		source := fmt.Sprintf("%s:%d", hostsFile, line+1)
+		addPTR(hosts, sources, ptrs, ss[0], ss[1], source)
 		for _, domain := range ss[1:] {
 			ip := ss[0]
 
@@ -82,52 +131,66 @@ func LoadHosts(hostsFile string) (hosts Hosts, err error) {
 
 			msg.SetEdns0(4096, false)
 			msg.Answer = append(msg.Answer, rr)
-			hosts[msg.Question[0].String()] = msg
+			// 0.0.0.0 and :: are the entries of the blocklists
+			if net.ParseIP(ip).IsUnspecified() {
+				addEDE(msg, D.ExtendedErrorCodeBlocked, "blocked by hosts")
+			}
+
+			key := msg.Question[0].String()
+			if old, ok := hosts[key]; ok && !D.IsDuplicate(old.Answer[0], rr) {
+				log.Printf("Hosts conflict: %s %s at %s overrides the entry at %s\n",
+					domain, ip, source, sources[key])
+			}
+			hosts[key] = msg
+			sources[key] = source
 		}
 	}
-	return
+	return nil
 }
 
-func listenHostsFile(r *Resolver, hostsFile string) {
-	go func() {
-		var err error
-
-		watch, err := fsnotify.NewWatcher()
-		if err != nil {
-			log.Println("Watch file error:", err.Error())
-			return
-		}
-
-		defer func() {
-			if err := watch.Close(); err != nil {
-				log.Println(err.Error())
-			}
-		}()
+// addPTR adds the reverse mapping of ip to domain, the first domain
+// that appears for an ip in a file is the canonical one, which overrides
+// the one of the earlier files.
+func addPTR(hosts Hosts, sources map[string]string, ptrs map[string]bool, ip, domain, source string) {
+	if net.ParseIP(ip) == nil {
+		return
+	}
+	reverse, err := D.ReverseAddr(ip)
+	if err != nil {
+		return
+	}
 
-		if err = watch.Add(hostsFile); err != nil {
-			log.Println("Watch file error:", err.Error())
-			return
-		}
+	msg := new(D.Msg)
+	msg.SetQuestion(reverse, D.TypePTR)
+	key := msg.Question[0].String()
+	if ptrs[key] {
+		return
+	}
+	ptrs[key] = true
+
+	rr := &D.PTR{
+		Hdr: D.RR_Header{
+			Name:   reverse,
+			Rrtype: D.TypePTR,
+			Class:  D.ClassINET,
+			Ttl:    86400,
+		},
+		Ptr: D.Fqdn(domain),
+	}
+	msg.SetEdns0(4096, false)
+	msg.Answer = append(msg.Answer, rr)
+	if old, ok := hosts[key]; ok && !D.IsDuplicate(old.Answer[0], rr) {
+		log.Printf("Hosts conflict: %s %s at %s overrides the entry at %s\n",
+			ip, rr.Ptr, source, sources[key])
+	}
+	hosts[key] = msg
+	sources[key] = source
+}
 
-		for {
-			select {
-			case ev := <-watch.Events:
-				if ev.Op == fsnotify.Write || ev.Op == fsnotify.Remove {
-					r.Hosts, err = LoadHosts(hostsFile)
-					if err != nil {
-						log.Println("Load hosts file error:", err.Error())
-					}
-				}
-				if ev.Op == fsnotify.Remove {
-					listenHostsFile(r, hostsFile)
-					return
-				}
-			case err := <-watch.Errors:
-				log.Println("Watch file error:", err.Error())
-				return
-			}
-		}
-	}()
+func listenHostsFile(r *Resolver, paths []string) {
+	watchFiles(paths, func() {
+		r.Hosts = LoadHosts(paths...)
+	})
 }
 
 func (h Hosts) queryHosts(q string) (msg *D.Msg, ok bool) {
@@ -0,0 +1,134 @@
+package resolver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	D "github.com/miekg/dns"
+)
+
+// writeHosts writes the hosts files of contents in dir, by name.
+func writeHosts(t *testing.T, dir string, contents map[string]string) {
+	t.Helper()
+	for name, content := range contents {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// hostsAnswer returns the answer of hosts to name and qtype, empty if
+// there is none.
+func hostsAnswer(hosts Hosts, name string, qtype uint16) string {
+	q := D.Question{Name: name, Qtype: qtype, Qclass: D.ClassINET}
+	msg, ok := hosts.queryHosts(q.String())
+	if !ok {
+		return ""
+	}
+	switch rr := msg.Answer[0].(type) {
+	case *D.A:
+		return rr.A.String()
+	case *D.AAAA:
+		return rr.AAAA.String()
+	case *D.PTR:
+		return rr.Ptr
+	}
+	return ""
+}
+
+func TestLoadHosts(t *testing.T) {
+	dir := t.TempDir()
+	writeHosts(t, dir, map[string]string{
+		"first": "# comment\n" +
+			"192.0.2.1 www.example.org web.example.org\n" +
+			"192.0.2.1 other.example.org\r\n" +
+			"2001:db8::1\twww.example.org\n" +
+			"192.0.2.2 mail.example.org\n",
+		"second": "192.0.2.9 www.example.org\n" +
+			"192.0.2.2 smtp.example.org\n" +
+			"192.0.2.2 imap.example.org\n" +
+			"0.0.0.0 ads.example.org\n",
+	})
+	dotd := filepath.Join(dir, "hosts.d")
+	if err := os.Mkdir(dotd, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeHosts(t, dotd, map[string]string{
+		"10-a":    "192.0.2.3 a.example.org\n",
+		"20-b":    "192.0.2.4 a.example.org\n",
+		".hidden": "192.0.2.5 hidden.example.org\n",
+	})
+
+	hosts := LoadHosts(
+		filepath.Join(dir, "first"),
+		filepath.Join(dir, "missing"),
+		filepath.Join(dir, "second"),
+		dotd,
+	)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string
+	}{
+		{"web.example.org.", D.TypeA, "192.0.2.1"},
+		{"www.example.org.", D.TypeAAAA, "2001:db8::1"},
+		// the later file wins
+		{"www.example.org.", D.TypeA, "192.0.2.9"},
+		{"a.example.org.", D.TypeA, "192.0.2.4"},
+		{"hidden.example.org.", D.TypeA, ""},
+		{"ads.example.org.", D.TypeA, "0.0.0.0"},
+		// the first name of an address in a file is its PTR
+		{"1.2.0.192.in-addr.arpa.", D.TypePTR, "www.example.org."},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", D.TypePTR, "www.example.org."},
+		// and overrides the one of the earlier files
+		{"2.2.0.192.in-addr.arpa.", D.TypePTR, "smtp.example.org."},
+		{"9.2.0.192.in-addr.arpa.", D.TypePTR, "www.example.org."},
+	}
+	for _, tt := range tests {
+		if got := hostsAnswer(hosts, tt.name, tt.qtype); got != tt.want {
+			t.Errorf("%s %s = %q, want %q", tt.name, D.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+
+	q := D.Question{Name: "ads.example.org.", Qtype: D.TypeA, Qclass: D.ClassINET}
+	if msg, _ := hosts.queryHosts(q.String()); msg.IsEdns0() == nil || len(msg.IsEdns0().Option) == 0 {
+		t.Error("no EDE for a blocked name")
+	}
+}
+
+func TestHostsPTR(t *testing.T) {
+	dir := t.TempDir()
+	writeHosts(t, dir, map[string]string{
+		"hosts": "192.0.2.1 host.example.org alias.example.org\n" +
+			"192.0.2.1 other.example.org\n" +
+			"2001:db8::1 host6.example.org.\n" +
+			"invalid name.example.org\n",
+	})
+	hosts := LoadHosts(filepath.Join(dir, "hosts"))
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		// the first name of the first line of an address
+		{"1.2.0.192.in-addr.arpa.", "host.example.org."},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", "host6.example.org."},
+	}
+	for _, tt := range tests {
+		if got := hostsAnswer(hosts, tt.name, D.TypePTR); got != tt.want {
+			t.Errorf("%s PTR = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	var ptrs int
+	for _, msg := range hosts {
+		if msg.Question[0].Qtype == D.TypePTR {
+			ptrs++
+		}
+	}
+	if ptrs != 2 {
+		t.Errorf("%d PTR records, want 2", ptrs)
+	}
+}
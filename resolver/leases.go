@@ -0,0 +1,281 @@
+package resolver
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	D "github.com/miekg/dns"
+)
+
+// maxLeaseTTL caps the TTL of answers from leases,
+// so that clients notice a new lease soon.
+const maxLeaseTTL = 300
+
+type LeasesConfig struct {
+	// Domain is the local domain appended to the lease hostnames,
+	// the hostnames are answered as they are if empty
+	Domain  string
+	Dnsmasq []string
+	Dhcpd   []string
+}
+
+type lease struct {
+	hostname string
+	ip       net.IP
+	// expires is zero for an infinite lease
+	expires time.Time
+}
+
+type Leases struct {
+	// names maps the lowercase fqdn of a host to its leases
+	names map[string][]*lease
+	// addrs maps the reverse name of an address to its lease
+	addrs map[string]*lease
+}
+
+func (l *lease) ttl(now time.Time) (uint32, bool) {
+	if l.expires.IsZero() {
+		return maxLeaseTTL, true
+	}
+	remain := l.expires.Sub(now)
+	if remain <= 0 {
+		return 0, false
+	}
+	if remain > maxLeaseTTL*time.Second {
+		return maxLeaseTTL, true
+	}
+	return uint32(remain.Seconds()), true
+}
+
+// parseDnsmasqLeases parses a dnsmasq lease file, whose lines look like
+// "<expires> <mac> <ip> <hostname> <client-id>".
+func parseDnsmasqLeases(file string) (leases []*lease, err error) {
+	s, err := loadFileToString(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range splitByLines(s) {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] == "*" {
+			continue
+		}
+
+		expires, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		l := &lease{hostname: fields[3], ip: net.ParseIP(fields[2])}
+		if expires != 0 {
+			l.expires = time.Unix(expires, 0)
+		}
+		leases = append(leases, l)
+	}
+	return
+}
+
+// parseDhcpdTime parses the time of a "starts" or "ends" statement in
+// ISC dhcpd.leases, which is "never", "epoch <seconds>" or
+// "<weekday> <yyyy/mm/dd> <hh:mm:ss>" in UTC.
+func parseDhcpdTime(fields []string) (t time.Time, ok bool) {
+	switch {
+	case len(fields) >= 1 && fields[0] == "never":
+		return time.Time{}, true
+	case len(fields) >= 2 && fields[0] == "epoch":
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return t, false
+		}
+		return time.Unix(sec, 0), true
+	case len(fields) >= 3:
+		t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+		if err != nil {
+			return t, false
+		}
+		return t, true
+	}
+	return t, false
+}
+
+// parseDhcpdLeases parses the lease declarations of ISC dhcpd.leases,
+// a later declaration of an address overrides the earlier one.
+func parseDhcpdLeases(file string) (leases []*lease, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	byIP := make(map[string]*lease)
+	var order []string
+
+	var current *lease
+	var active bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		line = strings.TrimSuffix(line, ";")
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if current == nil {
+			if fields[0] == "lease" && len(fields) >= 3 && fields[2] == "{" {
+				current = &lease{ip: net.ParseIP(fields[1])}
+				active = false
+			}
+			continue
+		}
+
+		switch fields[0] {
+		case "}":
+			if current.ip != nil {
+				key := current.ip.String()
+				if _, ok := byIP[key]; !ok {
+					order = append(order, key)
+				}
+				byIP[key] = nil
+				if active && current.hostname != "" {
+					byIP[key] = current
+				}
+			}
+			current = nil
+		case "ends":
+			if t, ok := parseDhcpdTime(fields[1:]); ok {
+				current.expires = t
+			}
+		case "binding":
+			active = len(fields) >= 3 && fields[1] == "state" && fields[2] == "active"
+		case "client-hostname":
+			if len(fields) >= 2 {
+				current.hostname = strings.Trim(strings.Join(fields[1:], " "), `"`)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, key := range order {
+		if l := byIP[key]; l != nil {
+			leases = append(leases, l)
+		}
+	}
+	return
+}
+
+func LoadLeases(config *LeasesConfig) (*Leases, error) {
+	var all []*lease
+	for _, file := range config.Dnsmasq {
+		leases, err := parseDnsmasqLeases(file)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, leases...)
+	}
+	for _, file := range config.Dhcpd {
+		leases, err := parseDhcpdLeases(file)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, leases...)
+	}
+
+	ls := &Leases{
+		names: make(map[string][]*lease),
+		addrs: make(map[string]*lease),
+	}
+	for _, l := range all {
+		if l.ip == nil {
+			continue
+		}
+		name := D.CanonicalName(l.hostname)
+		if config.Domain != "" {
+			name = D.CanonicalName(l.hostname + "." + D.Fqdn(config.Domain))
+		}
+		if _, ok := D.IsDomainName(name); !ok {
+			log.Printf("Skip the lease of %s: invalid hostname %q\n", l.ip, l.hostname)
+			continue
+		}
+		l.hostname = name
+		ls.names[name] = append(ls.names[name], l)
+
+		reverse, err := D.ReverseAddr(l.ip.String())
+		if err != nil {
+			continue
+		}
+		ls.addrs[reverse] = l
+	}
+	return ls, nil
+}
+
+func listenLeaseFiles(r *Resolver, config *LeasesConfig) {
+	paths := append(append([]string{}, config.Dnsmasq...), config.Dhcpd...)
+
+	watchFiles(paths, func() {
+		leases, err := LoadLeases(config)
+		if err != nil {
+			log.Println("Load lease file error:", err.Error())
+			return
+		}
+		r.Leases = leases
+	})
+}
+
+// queryLeases answers A, AAAA and PTR queries from the current leases.
+func (ls *Leases) queryLeases(q D.Question) (msg *D.Msg, ok bool) {
+	if ls == nil || q.Qclass != D.ClassINET {
+		return nil, false
+	}
+
+	now := time.Now()
+	name := D.CanonicalName(q.Name)
+
+	msg = new(D.Msg)
+	msg.SetQuestion(q.Name, q.Qtype)
+	msg.SetEdns0(4096, false)
+
+	switch q.Qtype {
+	case D.TypeA, D.TypeAAAA:
+		for _, l := range ls.names[name] {
+			ttl, valid := l.ttl(now)
+			if !valid {
+				continue
+			}
+			hdr := D.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: D.ClassINET, Ttl: ttl}
+			if ip4 := l.ip.To4(); ip4 != nil && q.Qtype == D.TypeA {
+				msg.Answer = append(msg.Answer, &D.A{Hdr: hdr, A: ip4})
+			} else if ip4 == nil && q.Qtype == D.TypeAAAA {
+				msg.Answer = append(msg.Answer, &D.AAAA{Hdr: hdr, AAAA: l.ip})
+			}
+		}
+	case D.TypePTR:
+		l := ls.addrs[name]
+		if l == nil {
+			return nil, false
+		}
+		ttl, valid := l.ttl(now)
+		if !valid {
+			return nil, false
+		}
+		msg.Answer = append(msg.Answer, &D.PTR{
+			Hdr: D.RR_Header{Name: q.Name, Rrtype: D.TypePTR, Class: D.ClassINET, Ttl: ttl},
+			Ptr: l.hostname,
+		})
+	}
+
+	if len(msg.Answer) == 0 {
+		return nil, false
+	}
+	return msg, true
+}
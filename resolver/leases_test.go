@@ -0,0 +1,126 @@
+package resolver
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	D "github.com/miekg/dns"
+)
+
+func TestLoadLeases(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	dnsmasq := filepath.Join(dir, "dnsmasq.leases")
+	dhcpd := filepath.Join(dir, "dhcpd.leases")
+	writeHosts(t, dir, map[string]string{
+		"dnsmasq.leases": fmt.Sprintf("%d 00:11:22:33:44:55 192.168.1.10 laptop 01:00:11:22:33:44:55\n", now.Add(time.Hour).Unix()) +
+			fmt.Sprintf("%d 00:11:22:33:44:56 192.168.1.11 soon *\n", now.Add(time.Hour).Unix()) +
+			fmt.Sprintf("%d 00:11:22:33:44:57 192.168.1.12 old *\n", now.Add(-time.Minute).Unix()) +
+			"0 00:11:22:33:44:58 192.168.1.13 printer *\n" +
+			fmt.Sprintf("%d 00:11:22:33:44:59 2001:db8::10 laptop *\n", now.Add(100*time.Second).Unix()) +
+			fmt.Sprintf("%d 00:11:22:33:44:5a 192.168.1.14 * *\n", now.Add(time.Hour).Unix()) +
+			fmt.Sprintf("%d 00:11:22:33:44:5b 192.168.1.15 %s *\n", now.Add(time.Hour).Unix(), strings.Repeat("x", 64)),
+		"dhcpd.leases": "# comment\n" +
+			"lease 192.168.2.10 {\n" +
+			"  starts epoch " + fmt.Sprint(now.Add(-time.Hour).Unix()) + ";\n" +
+			"  ends " + now.Add(time.Hour).UTC().Format("1 2006/01/02 15:04:05") + ";\n" +
+			"  binding state active;\n" +
+			"  client-hostname \"desktop\";\n" +
+			"}\n" +
+			"lease 192.168.2.11 {\n" +
+			"  ends never;\n" +
+			"  binding state active;\n" +
+			"  client-hostname \"nas\";\n" +
+			"}\n" +
+			// released later, the later declaration wins
+			"lease 192.168.2.11 {\n" +
+			"  ends never;\n" +
+			"  binding state free;\n" +
+			"}\n" +
+			"lease 192.168.2.12 {\n" +
+			"  ends epoch " + fmt.Sprint(now.Add(-time.Hour).Unix()) + ";\n" +
+			"  binding state active;\n" +
+			"  client-hostname \"gone\";\n" +
+			"}\n",
+	})
+
+	ls, err := LoadLeases(&LeasesConfig{Domain: "lan", Dnsmasq: []string{dnsmasq}, Dhcpd: []string{dhcpd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		// want is the data and TTL of the answer, empty for none
+		want string
+	}{
+		{"laptop.lan.", D.TypeA, "192.168.1.10 300"},
+		{"LAPTOP.lan.", D.TypeA, "192.168.1.10 300"},
+		{"laptop.lan.", D.TypeAAAA, "2001:db8::10 100"},
+		{"laptop.", D.TypeA, ""},
+		{"soon.lan.", D.TypeA, "192.168.1.11 300"},
+		{"old.lan.", D.TypeA, ""},
+		{"printer.lan.", D.TypeA, "192.168.1.13 300"},
+		{"desktop.lan.", D.TypeA, "192.168.2.10 300"},
+		{"nas.lan.", D.TypeA, ""},
+		{"gone.lan.", D.TypeA, ""},
+		{"10.1.168.192.in-addr.arpa.", D.TypePTR, "laptop.lan. 300"},
+		{"12.1.168.192.in-addr.arpa.", D.TypePTR, ""},
+		{"10.2.168.192.in-addr.arpa.", D.TypePTR, "desktop.lan. 300"},
+		{"14.1.168.192.in-addr.arpa.", D.TypePTR, ""},
+		{"15.1.168.192.in-addr.arpa.", D.TypePTR, ""},
+	}
+	for _, tt := range tests {
+		msg, ok := ls.queryLeases(D.Question{Name: tt.name, Qtype: tt.qtype, Qclass: D.ClassINET})
+		got := ""
+		if ok {
+			rr := msg.Answer[0]
+			switch rr := rr.(type) {
+			case *D.A:
+				got = rr.A.String()
+			case *D.AAAA:
+				got = rr.AAAA.String()
+			case *D.PTR:
+				got = rr.Ptr
+			}
+			// the TTL counts down, allow a second
+			ttl := rr.Header().Ttl
+			if ttl == 99 {
+				ttl = 100
+			}
+			got += fmt.Sprintf(" %d", ttl)
+		}
+		if got != tt.want {
+			t.Errorf("%s %s = %q, want %q", tt.name, D.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+
+	if _, err := LoadLeases(&LeasesConfig{Dnsmasq: []string{filepath.Join(dir, "missing")}}); err == nil {
+		t.Error("missing lease file loaded")
+	}
+}
+
+func TestParseDhcpdTime(t *testing.T) {
+	tests := []struct {
+		fields []string
+		want   time.Time
+		ok     bool
+	}{
+		{[]string{"never"}, time.Time{}, true},
+		{[]string{"epoch", "1700000000"}, time.Unix(1700000000, 0), true},
+		{[]string{"4", "2023/11/16", "22:13:20"}, time.Date(2023, 11, 16, 22, 13, 20, 0, time.UTC), true},
+		{[]string{"epoch", "soon"}, time.Time{}, false},
+		{[]string{"4", "2023-11-16", "22:13:20"}, time.Time{}, false},
+		{nil, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseDhcpdTime(tt.fields)
+		if ok != tt.ok || ok && !got.Equal(tt.want) {
+			t.Errorf("%q = %v %t, want %v %t", tt.fields, got, ok, tt.want, tt.ok)
+		}
+	}
+}
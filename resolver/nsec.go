@@ -0,0 +1,278 @@
+package resolver
+
+import (
+	"strings"
+
+	D "github.com/miekg/dns"
+)
+
+// canonicalCompare compares the names a and b in the canonical order of
+// RFC 4034 section 6.1, label by label from the rightmost one.
+func canonicalCompare(a, b string) int {
+	la := D.SplitDomainName(strings.ToLower(a))
+	lb := D.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// hasType reports whether the type bitmap has t.
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers reports whether name is between the owner and the next
+// name of n, the next name of the last NSEC of a zone is the apex.
+func nsecCovers(n *D.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, name) >= 0 {
+		return false
+	}
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(name, next) < 0
+	}
+	return D.IsSubDomain(next, name)
+}
+
+func nsecMatches(n *D.NSEC, name string) bool {
+	return canonicalCompare(n.Hdr.Name, name) == 0
+}
+
+// delegationBitmap reports whether the type bitmap is of a zone cut seen
+// from the parent zone, which only proves the types of the DS RRset.
+func delegationBitmap(bitmap []uint16) bool {
+	return hasType(bitmap, D.TypeNS) && !hasType(bitmap, D.TypeSOA)
+}
+
+// cutBitmap reports whether the type bitmap is of a zone cut seen from
+// the parent zone or of a DNAME. The names below it are in another zone,
+// and its NSEC or NSEC3 proves nothing about them (RFC 4035 section 5.4,
+// RFC 5155 section 8.3).
+func cutBitmap(bitmap []uint16) bool {
+	return delegationBitmap(bitmap) || hasType(bitmap, D.TypeDNAME)
+}
+
+// nsecProves reports whether n covers name and may prove it doesn't
+// exist, which it can't if name is below the zone cut or DNAME at its owner.
+func nsecProves(n *D.NSEC, name string) bool {
+	if !nsecCovers(n, name) {
+		return false
+	}
+	return !cutBitmap(n.TypeBitMap) || !D.IsSubDomain(n.Hdr.Name, name)
+}
+
+// nsecCloser returns the closest encloser of name proven by the NSEC
+// covering it, the longest common ancestor with its owner or next name.
+func nsecCloser(n *D.NSEC, name string) string {
+	labels := D.CompareDomainName(name, n.Hdr.Name)
+	if l := D.CompareDomainName(name, n.NextDomain); l > labels {
+		labels = l
+	}
+	if labels == 0 {
+		return "."
+	}
+	ls := D.SplitDomainName(D.CanonicalName(name))
+	return strings.Join(ls[len(ls)-labels:], ".") + "."
+}
+
+// wildcardOf returns the wildcard name at the closest encloser ce.
+func wildcardOf(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// nextCloser returns the name one label longer than ce towards name.
+func nextCloser(name, ce string) string {
+	ls := D.SplitDomainName(D.CanonicalName(name))
+	n := D.CountLabel(ce) + 1
+	if n > len(ls) {
+		return ""
+	}
+	return strings.Join(ls[len(ls)-n:], ".") + "."
+}
+
+// nsec3Encloser returns the closest encloser proof of name (RFC 5155
+// section 8.3), the closest encloser matched and the next closer name
+// covered, which may be in an opt-out span. The closest encloser can't be
+// a zone cut of the parent zone nor a DNAME.
+func nsec3Encloser(nsec3s []*D.NSEC3, name string) (ce string, optOut, ok bool) {
+	name = D.CanonicalName(name)
+	for cur := parent(name); ; cur = parent(cur) {
+		for _, n := range nsec3s {
+			if !n.Match(cur) {
+				continue
+			}
+			if cutBitmap(n.TypeBitMap) {
+				return "", false, false
+			}
+			nc := nextCloser(name, cur)
+			for _, c := range nsec3s {
+				if c.Cover(nc) {
+					return cur, c.Flags&0x01 != 0, true
+				}
+			}
+			return "", false, false
+		}
+		if cur == "." {
+			return "", false, false
+		}
+	}
+}
+
+// nsec3Matching returns the NSEC3 of name.
+func nsec3Matching(nsec3s []*D.NSEC3, name string) *D.NSEC3 {
+	for _, n := range nsec3s {
+		if n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func noNameError(name string) error {
+	return bogusError(D.ExtendedErrorCodeNSECMissing, "no proof that %s doesn't exist", name)
+}
+
+func noTypeError(name string, qtype uint16) error {
+	return bogusError(D.ExtendedErrorCodeNSECMissing, "no proof that %s has no %s", name, D.TypeToString[qtype])
+}
+
+// denyName checks the proof that name doesn't exist, nor the wildcard
+// of its closest encloser. In an opt-out span of NSEC3, name may still
+// be an unsigned delegation, and the proof is only insecure.
+func denyName(nsecs []*D.NSEC, nsec3s []*D.NSEC3, name string) (optOut bool, err error) {
+	if len(nsecs) > 0 {
+		for _, n := range nsecs {
+			if !nsecProves(n, name) {
+				continue
+			}
+			wildcard := wildcardOf(nsecCloser(n, name))
+			for _, w := range nsecs {
+				if nsecProves(w, wildcard) {
+					return false, nil
+				}
+			}
+		}
+		return false, noNameError(name)
+	}
+
+	ce, optOut, ok := nsec3Encloser(nsec3s, name)
+	if !ok {
+		return false, noNameError(name)
+	}
+	for _, n := range nsec3s {
+		if n.Cover(wildcardOf(ce)) {
+			return optOut, nil
+		}
+	}
+	return false, noNameError(name)
+}
+
+// denyType checks the proof that name has no record of qtype, nor a
+// wildcard it would match. A proof from an opt-out span of NSEC3 is only
+// insecure (RFC 5155 section 8.6).
+func denyType(nsecs []*D.NSEC, nsec3s []*D.NSEC3, name string, qtype uint16) (optOut bool, err error) {
+	// the NSEC or NSEC3 of a zone cut from the parent zone only proves
+	// the types of the DS RRset, the others are in the child zone
+	noType := func(bitmap []uint16) error {
+		if hasType(bitmap, qtype) || hasType(bitmap, D.TypeCNAME) ||
+			qtype != D.TypeDS && delegationBitmap(bitmap) {
+			return noTypeError(name, qtype)
+		}
+		return nil
+	}
+
+	if len(nsecs) > 0 {
+		for _, n := range nsecs {
+			if nsecMatches(n, name) {
+				return false, noType(n.TypeBitMap)
+			}
+		}
+		for _, n := range nsecs {
+			if !nsecProves(n, name) {
+				continue
+			}
+			// an empty non-terminal, the names below it exist
+			if D.IsSubDomain(name, n.NextDomain) {
+				return false, nil
+			}
+			wildcard := wildcardOf(nsecCloser(n, name))
+			for _, w := range nsecs {
+				if nsecMatches(w, wildcard) && !hasType(w.TypeBitMap, qtype) && !hasType(w.TypeBitMap, D.TypeCNAME) {
+					return false, nil
+				}
+			}
+		}
+		return false, noTypeError(name, qtype)
+	}
+
+	if n := nsec3Matching(nsec3s, name); n != nil {
+		return false, noType(n.TypeBitMap)
+	}
+	ce, optOut, ok := nsec3Encloser(nsec3s, name)
+	if !ok {
+		return false, noTypeError(name, qtype)
+	}
+	// an unsigned delegation in an opt-out span
+	if qtype == D.TypeDS && optOut {
+		return true, nil
+	}
+	if w := nsec3Matching(nsec3s, wildcardOf(ce)); w != nil &&
+		!hasType(w.TypeBitMap, qtype) && !hasType(w.TypeBitMap, D.TypeCNAME) {
+		return optOut, nil
+	}
+	return false, noTypeError(name, qtype)
+}
+
+// denyDS checks the proof that name has no DS, and tells whether name is
+// a delegation, which is then insecure, or in an opt-out span.
+func denyDS(nsecs []*D.NSEC, nsec3s []*D.NSEC3, name string) (cut, optOut bool, err error) {
+	for _, n := range nsecs {
+		if nsecMatches(n, name) {
+			if hasType(n.TypeBitMap, D.TypeDS) {
+				return false, false, noTypeError(name, D.TypeDS)
+			}
+			return delegationBitmap(n.TypeBitMap), false, nil
+		}
+	}
+	if len(nsecs) == 0 {
+		if n := nsec3Matching(nsec3s, name); n != nil {
+			if hasType(n.TypeBitMap, D.TypeDS) {
+				return false, false, noTypeError(name, D.TypeDS)
+			}
+			return delegationBitmap(n.TypeBitMap), false, nil
+		}
+	}
+	// not a zone cut: an empty non-terminal, a name of a wildcard, or a
+	// name in an opt-out span
+	optOut, err = denyType(nsecs, nsec3s, name, D.TypeDS)
+	return false, optOut, err
+}
+
+// denyWildcardName checks the proof that name, answered with the
+// wildcard at the closest encloser ce, doesn't exist (RFC 4035 section
+// 5.3.4, RFC 5155 section 8.8).
+func denyWildcardName(nsecs []*D.NSEC, nsec3s []*D.NSEC3, name, ce string) error {
+	for _, n := range nsecs {
+		if nsecProves(n, name) {
+			return nil
+		}
+	}
+	nc := nextCloser(name, ce)
+	for _, n := range nsec3s {
+		if nc != "" && n.Cover(nc) {
+			return nil
+		}
+	}
+	return noNameError(name)
+}
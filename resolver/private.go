@@ -0,0 +1,192 @@
+package resolver
+
+import (
+	"fmt"
+
+	D "github.com/miekg/dns"
+)
+
+// privateReverseZones are the locally served zones of RFC 6303,
+// reverse lookups for them must not be sent to the public upstreams.
+var privateReverseZones = []string{
+	// RFC 1918
+	"10.in-addr.arpa.",
+	"16.172.in-addr.arpa.",
+	"17.172.in-addr.arpa.",
+	"18.172.in-addr.arpa.",
+	"19.172.in-addr.arpa.",
+	"20.172.in-addr.arpa.",
+	"21.172.in-addr.arpa.",
+	"22.172.in-addr.arpa.",
+	"23.172.in-addr.arpa.",
+	"24.172.in-addr.arpa.",
+	"25.172.in-addr.arpa.",
+	"26.172.in-addr.arpa.",
+	"27.172.in-addr.arpa.",
+	"28.172.in-addr.arpa.",
+	"29.172.in-addr.arpa.",
+	"30.172.in-addr.arpa.",
+	"31.172.in-addr.arpa.",
+	"168.192.in-addr.arpa.",
+	// RFC 6598, the shared address space (RFC 7793)
+	"64.100.in-addr.arpa.",
+	"65.100.in-addr.arpa.",
+	"66.100.in-addr.arpa.",
+	"67.100.in-addr.arpa.",
+	"68.100.in-addr.arpa.",
+	"69.100.in-addr.arpa.",
+	"70.100.in-addr.arpa.",
+	"71.100.in-addr.arpa.",
+	"72.100.in-addr.arpa.",
+	"73.100.in-addr.arpa.",
+	"74.100.in-addr.arpa.",
+	"75.100.in-addr.arpa.",
+	"76.100.in-addr.arpa.",
+	"77.100.in-addr.arpa.",
+	"78.100.in-addr.arpa.",
+	"79.100.in-addr.arpa.",
+	"80.100.in-addr.arpa.",
+	"81.100.in-addr.arpa.",
+	"82.100.in-addr.arpa.",
+	"83.100.in-addr.arpa.",
+	"84.100.in-addr.arpa.",
+	"85.100.in-addr.arpa.",
+	"86.100.in-addr.arpa.",
+	"87.100.in-addr.arpa.",
+	"88.100.in-addr.arpa.",
+	"89.100.in-addr.arpa.",
+	"90.100.in-addr.arpa.",
+	"91.100.in-addr.arpa.",
+	"92.100.in-addr.arpa.",
+	"93.100.in-addr.arpa.",
+	"94.100.in-addr.arpa.",
+	"95.100.in-addr.arpa.",
+	"96.100.in-addr.arpa.",
+	"97.100.in-addr.arpa.",
+	"98.100.in-addr.arpa.",
+	"99.100.in-addr.arpa.",
+	"100.100.in-addr.arpa.",
+	"101.100.in-addr.arpa.",
+	"102.100.in-addr.arpa.",
+	"103.100.in-addr.arpa.",
+	"104.100.in-addr.arpa.",
+	"105.100.in-addr.arpa.",
+	"106.100.in-addr.arpa.",
+	"107.100.in-addr.arpa.",
+	"108.100.in-addr.arpa.",
+	"109.100.in-addr.arpa.",
+	"110.100.in-addr.arpa.",
+	"111.100.in-addr.arpa.",
+	"112.100.in-addr.arpa.",
+	"113.100.in-addr.arpa.",
+	"114.100.in-addr.arpa.",
+	"115.100.in-addr.arpa.",
+	"116.100.in-addr.arpa.",
+	"117.100.in-addr.arpa.",
+	"118.100.in-addr.arpa.",
+	"119.100.in-addr.arpa.",
+	"120.100.in-addr.arpa.",
+	"121.100.in-addr.arpa.",
+	"122.100.in-addr.arpa.",
+	"123.100.in-addr.arpa.",
+	"124.100.in-addr.arpa.",
+	"125.100.in-addr.arpa.",
+	"126.100.in-addr.arpa.",
+	"127.100.in-addr.arpa.",
+	// RFC 5735
+	"0.in-addr.arpa.",
+	"127.in-addr.arpa.",
+	"254.169.in-addr.arpa.",
+	"2.0.192.in-addr.arpa.",
+	"100.51.198.in-addr.arpa.",
+	"113.0.203.in-addr.arpa.",
+	"255.255.255.255.in-addr.arpa.",
+	// RFC 4291
+	"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+	"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+	// RFC 4193
+	"d.f.ip6.arpa.",
+	// RFC 4291
+	"8.e.f.ip6.arpa.",
+	"9.e.f.ip6.arpa.",
+	"a.e.f.ip6.arpa.",
+	"b.e.f.ip6.arpa.",
+	// RFC 3849
+	"8.b.d.0.1.0.0.2.ip6.arpa.",
+}
+
+const (
+	PrivateReverseNXDomain = "nxdomain"
+	PrivateReverseForward  = "forward"
+)
+
+// newEmptyZone returns the empty zone described in RFC 6303 section 3.
+func newEmptyZone(origin string) *Zone {
+	soa := &D.SOA{
+		Hdr: D.RR_Header{
+			Name:   origin,
+			Rrtype: D.TypeSOA,
+			Class:  D.ClassINET,
+			Ttl:    10800,
+		},
+		Ns:      origin,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  10800,
+	}
+	ns := &D.NS{
+		Hdr: D.RR_Header{
+			Name:   origin,
+			Rrtype: D.TypeNS,
+			Class:  D.ClassINET,
+			Ttl:    10800,
+		},
+		Ns: origin,
+	}
+
+	return &Zone{
+		Origin:  origin,
+		soa:     soa,
+		records: map[string][]D.RR{origin: {soa, ns}},
+		names:   map[string]bool{origin: true},
+	}
+}
+
+func (r *Resolver) setPrivateReverse(config *Config) (err error) {
+	switch config.PrivateReverse {
+	case "":
+		return nil
+	case PrivateReverseNXDomain:
+	case PrivateReverseForward:
+		if len(config.PrivateReverseClientsConfig) == 0 {
+			return fmt.Errorf("private reverse policy is %s, but no upstream is set", PrivateReverseForward)
+		}
+		r.privateResolver, err = NewResolver(&Config{
+			ClientsConfig: config.PrivateReverseClientsConfig,
+			Strategy:      "fallback",
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Invalid private reverse policy: %s", config.PrivateReverse)
+	}
+
+	for _, origin := range privateReverseZones {
+		r.privateZones = append(r.privateZones, newEmptyZone(origin))
+	}
+	return nil
+}
+
+// queryPrivateReverse answers the query in a private reverse zone from
+// the internal resolver if there is one, or with NXDOMAIN. A failure of
+// the internal resolver isn't an NXDOMAIN, the names may exist.
+func (r *Resolver) queryPrivateReverse(z *Zone, m *D.Msg) (*D.Msg, error) {
+	if r.privateResolver != nil {
+		return r.privateResolver.Exchange(m)
+	}
+	return z.Exchange(m), nil
+}
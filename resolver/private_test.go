@@ -0,0 +1,115 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+
+	D "github.com/miekg/dns"
+)
+
+// serveUDP serves handler on a loopback UDP port, and returns its url.
+func serveUDP(t *testing.T, handler D.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &D.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = srv.Shutdown()
+	})
+	return "udp://" + pc.LocalAddr().String()
+}
+
+func TestPrivateReverse(t *testing.T) {
+	// the internal server knows 192.168.1.1 and fails for 10.0.0.1
+	internal := serveUDP(t, func(w D.ResponseWriter, m *D.Msg) {
+		msg := new(D.Msg)
+		msg.SetReply(m)
+		switch m.Question[0].Name {
+		case "1.1.168.192.in-addr.arpa.":
+			rr, _ := D.NewRR("1.1.168.192.in-addr.arpa. 300 IN PTR router.lan.")
+			msg.Answer = append(msg.Answer, rr)
+		default:
+			msg.Rcode = D.RcodeServerFailure
+		}
+		_ = w.WriteMsg(msg)
+	})
+	public := func(m *D.Msg, _ *Resolver) (*D.Msg, error) {
+		msg := new(D.Msg)
+		msg.SetReply(m)
+		rr, _ := D.NewRR(m.Question[0].Name + " 300 IN PTR public.example.")
+		msg.Answer = append(msg.Answer, rr)
+		return msg, nil
+	}
+
+	tests := []struct {
+		name   string
+		policy string
+		qname  string
+		rcode  int
+		// ptr is the target of the answer, empty for none
+		ptr string
+	}{
+		{name: "unset", qname: "1.1.168.192.in-addr.arpa.", ptr: "public.example."},
+		{name: "nxdomain", policy: PrivateReverseNXDomain, qname: "1.1.168.192.in-addr.arpa.", rcode: D.RcodeNameError},
+		{name: "nxdomain ula", policy: PrivateReverseNXDomain, qname: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", rcode: D.RcodeNameError},
+		{name: "nxdomain shared", policy: PrivateReverseNXDomain, qname: "1.0.64.100.in-addr.arpa.", rcode: D.RcodeNameError},
+		{name: "nxdomain shared end", policy: PrivateReverseNXDomain, qname: "1.255.127.100.in-addr.arpa.", rcode: D.RcodeNameError},
+		{name: "nxdomain after shared", policy: PrivateReverseNXDomain, qname: "1.0.128.100.in-addr.arpa.", ptr: "public.example."},
+		{name: "nxdomain apex", policy: PrivateReverseNXDomain, qname: "10.in-addr.arpa.", ptr: ""},
+		{name: "nxdomain public", policy: PrivateReverseNXDomain, qname: "8.8.8.8.in-addr.arpa.", ptr: "public.example."},
+		{name: "forward", policy: PrivateReverseForward, qname: "1.1.168.192.in-addr.arpa.", ptr: "router.lan."},
+		// a failure isn't a NXDOMAIN, the name may exist
+		{name: "forward failure", policy: PrivateReverseForward, qname: "1.0.0.10.in-addr.arpa.", rcode: D.RcodeServerFailure},
+		{name: "forward public", policy: PrivateReverseForward, qname: "8.8.8.8.in-addr.arpa.", ptr: "public.example."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Resolver{StrategyFun: public}
+			err := r.setPrivateReverse(&Config{
+				PrivateReverse:              tt.policy,
+				PrivateReverseClientsConfig: []*ClientConfig{{URL: internal}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := new(D.Msg)
+			m.SetQuestion(tt.qname, D.TypePTR)
+			msg, err := r.Exchange(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", D.RcodeToString[msg.Rcode], D.RcodeToString[tt.rcode])
+			}
+			ptr := ""
+			for _, rr := range msg.Answer {
+				if rr, ok := rr.(*D.PTR); ok {
+					ptr = rr.Ptr
+				}
+			}
+			if ptr != tt.ptr {
+				t.Errorf("PTR %q, want %q", ptr, tt.ptr)
+			}
+			if tt.policy == PrivateReverseNXDomain && tt.ptr == "" && len(msg.Ns) == 0 {
+				t.Error("no SOA in the negative answer")
+			}
+		})
+	}
+
+	for _, config := range []*Config{
+		{PrivateReverse: PrivateReverseForward},
+		{PrivateReverse: "drop"},
+	} {
+		if err := new(Resolver).setPrivateReverse(config); err == nil {
+			t.Errorf("policy %q accepted", config.PrivateReverse)
+		}
+	}
+}
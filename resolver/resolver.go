@@ -24,8 +24,18 @@ type Client struct {
 }
 
 type ClientConfig struct {
-	URL    string
-	Weight int
+	URL             string
+	Weight          int
+	Timeout         time.Duration
+	DisableTCPRetry bool
+	TLS             *dns.TLSOptions
+	Proxy           string
+	Bind            string
+	Mark            int
+	PaddingBlock    int
+	// Domains limits the upstream to the names in these domains,
+	// which the upstreams without domains don't serve
+	Domains []string
 }
 
 type Config struct {
@@ -33,10 +43,24 @@ type Config struct {
 	Cache         bool
 	Strategy      string
 	MaxRetries    int
+	// PrivateReverse is the policy for reverse lookups of private ranges,
+	// "nxdomain", "forward" or empty to send them to the upstreams
+	PrivateReverse              string
+	PrivateReverseClientsConfig []*ClientConfig
+	// ECS is the EDNS Client Subnet policy, passthrough if nil
+	ECS *ECSConfig
+	// DNSSEC validates the answers of the upstreams, no validation if nil
+	DNSSEC *DNSSECConfig
+	// DNS64 synthesizes the AAAA records for IPv6-only clients, none if nil
+	DNS64 *DNS64Config
+	// AddressFamily drops the A or AAAA records, no filtering if nil
+	AddressFamily *AddressFamilyConfig
 }
 
 type Resolver struct {
 	Hosts           Hosts
+	Leases          *Leases
+	Zones           Zones
 	StrategyFun     queryStrategy
 	Clients         []*Client
 	okClientNum     int
@@ -44,12 +68,27 @@ type Resolver struct {
 	weightSum       int
 	crontab         *cron.Cron
 	MaxRetries      int
+	privateZones    Zones
+	privateResolver *Resolver
+	ecs             *ecsPolicy
+	validator       *validator
+	domainResolvers map[string]*Resolver
+	dns64           *dns64
+	family          *familyPolicy
 }
 
 func createClients(clientsConfig []*ClientConfig) []*Client {
 	var ret []*Client
 	for _, config := range clientsConfig {
-		d, err := dns.NewClient(config.URL)
+		d, err := dns.NewClient(config.URL, &dns.ClientOptions{
+			Timeout:         config.Timeout,
+			DisableTCPRetry: config.DisableTCPRetry,
+			TLS:             config.TLS,
+			Proxy:           config.Proxy,
+			Bind:            config.Bind,
+			Mark:            config.Mark,
+			PaddingBlock:    config.PaddingBlock,
+		})
 		if err != nil {
 			log.Println(err.Error())
 			continue
@@ -67,7 +106,11 @@ func createClients(clientsConfig []*ClientConfig) []*Client {
 func NewResolver(config *Config) (r *Resolver, err error) {
 	r = new(Resolver)
 
-	r.Clients = createClients(config.ClientsConfig)
+	clientsConfig, err := r.setDomainResolvers(config)
+	if err != nil {
+		return nil, err
+	}
+	r.Clients = createClients(clientsConfig)
 
 	r.okClientNum = len(r.Clients)
 
@@ -115,18 +158,71 @@ func NewResolver(config *Config) (r *Resolver, err error) {
 		return nil, fmt.Errorf("Invalid strategy: %s", config.Strategy)
 	}
 
+	if r.ecs, err = newECSPolicy(config.ECS); err != nil {
+		return nil, err
+	}
+
+	if r.dns64, err = newDNS64(config.DNS64); err != nil {
+		return nil, err
+	}
+
+	if r.family, err = newFamilyPolicy(config.AddressFamily); err != nil {
+		return nil, err
+	}
+
+	if err = r.setPrivateReverse(config); err != nil {
+		return nil, err
+	}
+
 	r.crontab = cron.New()
 	_, _ = r.crontab.AddFunc("@every 300s", r.recoverClient)
+
+	if config.DNSSEC != nil {
+		if r.validator, err = newValidator(r, config.DNSSEC); err != nil {
+			return nil, err
+		}
+		// the active refresh of the root keys (RFC 5011 section 2.3)
+		if config.DNSSEC.TrustAnchorFile != "" {
+			_, _ = r.crontab.AddFunc("@every 12h", r.validator.refresh)
+		}
+	}
 	r.crontab.Start()
 
 	return
 }
 
 func (r *Resolver) Exchange(m *D.Msg) (msg *D.Msg, err error) {
+	return r.ExchangeFrom(m, "")
+}
+
+// ExchangeFrom answers the query m from the client at addr, which is
+// the source of the ECS option synthesized for the upstreams.
+func (r *Resolver) ExchangeFrom(m *D.Msg, addr string) (msg *D.Msg, err error) {
 	if len(m.Question) == 0 {
 		return nil, errors.New("should have one question at least")
 	}
 
+	msg, err = r.exchange(m, addr)
+
+	// the synthesized answers are made from the cached AAAA and A answers,
+	// so the clients without DNS64 never get them
+	if r.dns64.applies(m, addr) && r.dns64.needed(msg) {
+		a := m.Copy()
+		a.Question[0].Qtype = D.TypeA
+		am, aerr := r.exchange(a, addr)
+		if aerr != nil {
+			log.Println(aerr.Error())
+		}
+		if am != nil {
+			msg = r.dns64.synthesize(msg, am)
+		}
+	}
+
+	msg = r.filterFamily(m, msg, addr)
+	return
+}
+
+func (r *Resolver) exchange(m *D.Msg, addr string) (msg *D.Msg, err error) {
 	q := m.Question[0]
 
 	h, hit := r.Hosts.queryHosts(q.String())
@@ -135,53 +231,131 @@ func (r *Resolver) Exchange(m *D.Msg) (msg *D.Msg, err error) {
 		return
 	}
 
+	if l, hit := r.Leases.queryLeases(q); hit {
+		return l, nil
+	}
+
+	if z := r.Zones.match(q.Name); z != nil {
+		return z.Exchange(m), nil
+	}
+
+	if z := r.privateZones.match(q.Name); z != nil {
+		return r.queryPrivateReverse(z, m)
+	}
+
+	ecs := r.ecs.subnet(m, addr)
+	defer func() {
+		replyECS(msg, m, ecsScope(msg, ecs))
+	}()
+
 	if r.lruExpiresCache != nil {
-		cache, expireTime, hit := r.lruExpiresCache.Get(q.String())
+		key := q.String()
+		// the answers with DNSSEC records are kept apart, and the ones
+		// with AD for the clients setting it without DO
+		if opt := m.IsEdns0(); opt != nil && opt.Do() {
+			key += " DO"
+		} else if r.validator != nil && m.AuthenticatedData {
+			key += " AD"
+		}
+		// and the ones not validated for the clients
+		if r.validator != nil && m.CheckingDisabled {
+			key += " CD"
+		}
+		cache, expireTime, hit := getMsgFromCache(r.lruExpiresCache, key, ecs)
 		if hit {
 			now := time.Now()
-			msg = cache.(*D.Msg).Copy()
+			msg = cache.Copy()
 			if expireTime.Before(now) {
 				setMsgTTL(msg, uint32(1))
+				addEDE(msg, D.ExtendedErrorCodeStaleAnswer, "")
 				go func() {
-					update, err := r.queryUpstream(m)
+					update, err := r.queryUpstream(m, ecs)
 					if err != nil {
 						log.Println(err)
 					}
-					putMsgToCache(r.lruExpiresCache, m.Question[0].String(), update)
+					putMsgToCache(r.lruExpiresCache, ecsCacheKey(key, ecs, ecsScope(update, ecs)), update)
 				}()
 			} else {
 				setMsgTTL(msg, uint32(time.Until(expireTime).Seconds()))
 			}
 		} else {
-			msg, err = r.queryUpstream(m)
-			putMsgToCache(r.lruExpiresCache, m.Question[0].String(), msg)
+			msg, err = r.queryUpstream(m, ecs)
+			putMsgToCache(r.lruExpiresCache, ecsCacheKey(key, ecs, ecsScope(msg, ecs)), msg)
 		}
 		return
 	}
 
-	return r.queryUpstream(m)
+	return r.queryUpstream(m, ecs)
 }
 
-func (r *Resolver) queryUpstream(m *D.Msg) (msg *D.Msg, err error) {
+// queryUpstream sends a copy of m to the upstreams with the ECS option
+// ecs, or without one if it is nil. The other EDNS options of the client
+// are kept, except the ones only meaningful between two hops.
+func (r *Resolver) queryUpstream(m *D.Msg, ecs *D.EDNS0_SUBNET) (msg *D.Msg, err error) {
+	client := m
+	m = m.Copy()
+
 	if e := m.IsEdns0(); e != nil {
 		e.SetUDPSize(4096)
+		options := e.Option[:0]
+		for _, o := range e.Option {
+			switch o.(type) {
+			case *D.EDNS0_COOKIE, *D.EDNS0_PADDING, *D.EDNS0_TCP_KEEPALIVE:
+			default:
+				options = append(options, o)
+			}
+		}
+		e.Option = options
 	} else {
 		m.SetEdns0(4096, false)
 	}
+	setECS(m, ecs)
+	// the validation needs the DNSSEC records, even of the bogus answers
+	if r.validator != nil {
+		m.IsEdns0().SetDo()
+		m.CheckingDisabled = true
+	}
 
-	msg, err = r.StrategyFun(m, r)
+	msg, err = r.strategy(m)
+	if msg == nil {
+		err = upstreamError(err)
+	} else if r.validator != nil {
+		msg, err = r.validator.check(client, msg)
+	}
 
 	return
 }
 
+// ResolveHost returns an IP of host, of the address family preferred by
+// the mode for the queries of leedns itself, IPv4 if there is none.
 func (r *Resolver) ResolveHost(host string) (ip net.IP, err error) {
 	ip = net.ParseIP(host)
 	if ip != nil {
 		return ip, nil
 	}
 
+	var qtypes []uint16
+	switch r.family.modeOf("") {
+	case dns.PreferIPv4:
+		qtypes = []uint16{D.TypeA, D.TypeAAAA}
+	case dns.PreferIPv6:
+		qtypes = []uint16{D.TypeAAAA, D.TypeA}
+	case dns.IPv6Only:
+		qtypes = []uint16{D.TypeAAAA}
+	default:
+		qtypes = []uint16{D.TypeA}
+	}
+	for _, qtype := range qtypes {
+		if ip, err = r.resolveHost(host, qtype); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, err
+}
+
+func (r *Resolver) resolveHost(host string, qtype uint16) (ip net.IP, err error) {
 	m := new(D.Msg)
-	m.SetQuestion(D.Fqdn(host), D.TypeA)
+	m.SetQuestion(D.Fqdn(host), qtype)
 
 	msg, err := r.Exchange(m)
 	if err != nil {
@@ -204,6 +378,14 @@ func (r *Resolver) ResolveHost(host string) (ip net.IP, err error) {
 	return
 }
 
-func (r *Resolver) ListenHostsFile(hostsFile string) {
-	listenHostsFile(r, hostsFile)
+func (r *Resolver) ListenHostsFile(paths ...string) {
+	listenHostsFile(r, paths)
+}
+
+func (r *Resolver) ListenZoneFiles(configs ...*ZoneConfig) {
+	listenZoneFiles(r, configs)
+}
+
+func (r *Resolver) ListenLeaseFiles(config *LeasesConfig) {
+	listenLeaseFiles(r, config)
 }
@@ -0,0 +1,57 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// subnets is a list of IP ranges, like the clients of a feature.
+type subnets []*net.IPNet
+
+// parseSubnets parses the IPs and CIDRs in ss, an IP is a range of itself.
+func parseSubnets(ss []string) (ret subnets, err error) {
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", s)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, subnet)
+	}
+	return
+}
+
+func (s subnets) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range s {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostIP returns the IP of addr, with or without a port, nil if addr
+// isn't an IP address.
+func hostIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,268 @@
+package resolver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	D "github.com/miekg/dns"
+)
+
+// rootAnchors are the DS of the root KSK-2017 and KSK-2024.
+var rootAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// The states of the trust anchors of RFC 5011, a key is trusted once it
+// has been seen for the add hold-down time, a revoked key is removed.
+const (
+	anchorValid   = "valid"
+	anchorPending = "addpend"
+	addHoldDown   = 30 * 24 * time.Hour
+)
+
+type trustAnchor struct {
+	// rr is a DS or a DNSKEY of the root
+	rr    D.RR
+	state string
+	since time.Time
+}
+
+type trustAnchors struct {
+	mu      sync.Mutex
+	anchors []*trustAnchor
+	// file keeps the anchors updated with RFC 5011, none if empty
+	file string
+}
+
+func newTrustAnchors(config *DNSSECConfig) (*trustAnchors, error) {
+	t := &trustAnchors{file: config.TrustAnchorFile}
+	if t.file != "" {
+		err := t.load()
+		if err == nil {
+			return t, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	records := config.TrustAnchors
+	if len(records) == 0 {
+		records = rootAnchors
+	}
+	now := time.Now()
+	for _, s := range records {
+		rr, err := parseAnchor(s)
+		if err != nil {
+			return nil, err
+		}
+		t.anchors = append(t.anchors, &trustAnchor{rr: rr, state: anchorValid, since: now})
+	}
+
+	if t.file != "" {
+		if err := t.save(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func parseAnchor(s string) (D.RR, error) {
+	rr, err := D.NewRR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust anchor %q: %w", s, err)
+	}
+	switch rr.(type) {
+	case *D.DS, *D.DNSKEY:
+	default:
+		return nil, fmt.Errorf("invalid trust anchor %q: not a DS or DNSKEY", s)
+	}
+	if rr.Header().Name != "." {
+		return nil, fmt.Errorf("invalid trust anchor %q: not of the root", s)
+	}
+	return rr, nil
+}
+
+// load reads the anchors from the file, one record a line followed by
+// a comment of its state, like "; state=valid since=2024-01-01T00:00:00Z".
+func (t *trustAnchors) load() error {
+	s, err := loadFileToString(t.file)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range splitByLines(s) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		record, comment := line, ""
+		if i := strings.Index(line, ";"); i >= 0 {
+			record, comment = line[:i], line[i+1:]
+		}
+		rr, err := parseAnchor(record)
+		if err != nil {
+			return err
+		}
+
+		a := &trustAnchor{rr: rr, state: anchorValid}
+		for _, field := range strings.Fields(comment) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "state":
+				a.state = kv[1]
+			case "since":
+				a.since, _ = time.Parse(time.RFC3339, kv[1])
+			}
+		}
+		if a.state != anchorValid && a.state != anchorPending {
+			return fmt.Errorf("invalid trust anchor state %s in %s", a.state, t.file)
+		}
+		t.anchors = append(t.anchors, a)
+	}
+	if len(t.anchors) == 0 {
+		return fmt.Errorf("no trust anchor in %s", t.file)
+	}
+	return nil
+}
+
+func (t *trustAnchors) save() error {
+	var b strings.Builder
+	b.WriteString("; the root trust anchors of leedns, updated with RFC 5011\n")
+	for _, a := range t.anchors {
+		fmt.Fprintf(&b, "%s ; state=%s since=%s\n", a.rr.String(), a.state, a.since.UTC().Format(time.RFC3339))
+	}
+	return ioutil.WriteFile(t.file, []byte(b.String()), 0644)
+}
+
+// anchorMatches reports whether the key k is the one of the anchor rr.
+func anchorMatches(rr D.RR, k *D.DNSKEY) bool {
+	switch a := rr.(type) {
+	case *D.DS:
+		kd := k.ToDS(a.DigestType)
+		return kd != nil && kd.KeyTag == a.KeyTag && kd.Algorithm == a.Algorithm && strings.EqualFold(kd.Digest, a.Digest)
+	case *D.DNSKEY:
+		return a.Algorithm == k.Algorithm && a.Protocol == k.Protocol && a.PublicKey == k.PublicKey
+	}
+	return false
+}
+
+// trusted returns the keys of rrs trusted by the valid anchors.
+func (t *trustAnchors) trusted(rrs []D.RR) (keys []*D.DNSKEY) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, rr := range rrs {
+		k, ok := rr.(*D.DNSKEY)
+		if !ok || k.Flags&D.REVOKE != 0 {
+			continue
+		}
+		for _, a := range t.anchors {
+			if a.state == anchorValid && anchorMatches(a.rr, k) {
+				keys = append(keys, k)
+				break
+			}
+		}
+	}
+	return
+}
+
+// update applies RFC 5011 to the anchors with the validated DNSKEY RRset
+// of the root: the new KSKs are added after the hold-down time, and the
+// keys revoked by themselves are removed.
+func (t *trustAnchors) update(set *rrset) {
+	if t.file == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	changed := false
+	remove := func(k *D.DNSKEY) {
+		anchors := t.anchors[:0]
+		for _, a := range t.anchors {
+			if anchorMatches(a.rr, k) {
+				log.Printf("Trust anchor of the root key %d removed\n", k.KeyTag())
+				changed = true
+				continue
+			}
+			anchors = append(anchors, a)
+		}
+		t.anchors = anchors
+	}
+
+	var seen []*trustAnchor
+	for _, rr := range set.rrs {
+		k, ok := rr.(*D.DNSKEY)
+		if !ok || k.Flags&D.SEP == 0 {
+			continue
+		}
+
+		if k.Flags&D.REVOKE != 0 {
+			// a revocation only counts if signed by the revoked key
+			for _, sig := range set.sigs {
+				if sig.KeyTag == k.KeyTag() && sig.Verify(k, set.rrs) == nil {
+					unrevoked := *k
+					unrevoked.Flags &^= D.REVOKE
+					remove(&unrevoked)
+					break
+				}
+			}
+			continue
+		}
+
+		var found *trustAnchor
+		for _, a := range t.anchors {
+			if anchorMatches(a.rr, k) {
+				found = a
+				break
+			}
+		}
+		switch {
+		case found == nil:
+			found = &trustAnchor{rr: D.Copy(k), state: anchorPending, since: now}
+			t.anchors = append(t.anchors, found)
+			log.Printf("New root key %d pending as trust anchor until %s\n", k.KeyTag(), now.Add(addHoldDown).Format(time.RFC3339))
+			changed = true
+		case found.state == anchorPending && now.Sub(found.since) >= addHoldDown:
+			found.state = anchorValid
+			log.Printf("Root key %d added as trust anchor\n", k.KeyTag())
+			changed = true
+		}
+		seen = append(seen, found)
+	}
+
+	// a pending key gone from the root starts over
+	anchors := t.anchors[:0]
+	for _, a := range t.anchors {
+		pending := a.state == anchorPending
+		for _, s := range seen {
+			if s == a {
+				pending = false
+				break
+			}
+		}
+		if pending {
+			changed = true
+			continue
+		}
+		anchors = append(anchors, a)
+	}
+	t.anchors = anchors
+
+	if changed {
+		if err := t.save(); err != nil {
+			log.Println("Save trust anchors error:", err.Error())
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package resolver
 
 import (
+	"log"
+	"path/filepath"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	LEC "github.com/zekexy/leedns/cache"
 	D "github.com/miekg/dns"
 )
@@ -25,7 +28,8 @@ func setMsgTTL(msg *D.Msg, ttl uint32) {
 }
 
 func putMsgToCache(cache *LEC.LruExpiresCache, key string, msg *D.Msg) {
-	if msg == nil || msg.Answer == nil {
+	// a truncated response is incomplete
+	if msg == nil || msg.Answer == nil || msg.Truncated {
 		return
 	}
 
@@ -44,6 +48,25 @@ func putMsgToCache(cache *LEC.LruExpiresCache, key string, msg *D.Msg) {
 	cache.Add(key, msg.Copy(), time.Now().Add(time.Second*time.Duration(ttl)))
 }
 
+// getMsgFromCache looks up the answer for the subnet of ecs, from its
+// source prefix down to the answers of scope 0.
+func getMsgFromCache(cache *LEC.LruExpiresCache, key string, ecs *D.EDNS0_SUBNET) (msg *D.Msg, expireTime time.Time, hit bool) {
+	var prefix uint8
+	if ecs != nil {
+		prefix = ecs.SourceNetmask
+	}
+	for {
+		v, expireTime, hit := cache.Get(ecsCacheKey(key, ecs, prefix))
+		if hit {
+			return v.(*D.Msg), expireTime, true
+		}
+		if ecs == nil || prefix == 0 {
+			return nil, expireTime, false
+		}
+		prefix--
+	}
+}
+
 func gcdN(digits []int) int {
 	l := len(digits)
 	if l == 1 {
@@ -60,3 +83,52 @@ func gcdN(digits []int) int {
 
 	return gcd(digits[l-1], gcdN(digits[:l-1]))
 }
+
+// watchFiles calls reload whenever one of the files or directories in
+// paths changes, including files added to or removed from a directory.
+func watchFiles(paths []string, reload func()) {
+	go func() {
+		var err error
+
+		watch, err := fsnotify.NewWatcher()
+		if err != nil {
+			log.Println("Watch file error:", err.Error())
+			return
+		}
+
+		defer func() {
+			if err := watch.Close(); err != nil {
+				log.Println(err.Error())
+			}
+		}()
+
+		watched := make(map[string]bool)
+		for _, p := range paths {
+			if err = watch.Add(p); err != nil {
+				log.Println("Watch file error:", err.Error())
+				continue
+			}
+			watched[filepath.Clean(p)] = true
+		}
+		if len(watched) == 0 {
+			return
+		}
+
+		for {
+			select {
+			case ev := <-watch.Events:
+				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+					reload()
+				}
+				// a removed file may be recreated, restart to watch it again
+				if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && watched[filepath.Clean(ev.Name)] {
+					watchFiles(paths, reload)
+					return
+				}
+			case err := <-watch.Errors:
+				log.Println("Watch file error:", err.Error())
+				return
+			}
+		}
+	}()
+}
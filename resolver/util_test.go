@@ -0,0 +1,67 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	LEC "github.com/zekexy/leedns/cache"
+	D "github.com/miekg/dns"
+)
+
+func TestPutMsgToCache(t *testing.T) {
+	truncated := testMsg(t, "www.example.org.", D.TypeA, "www.example.org. 300 IN A 192.0.2.1")
+	truncated.Truncated = true
+
+	tests := []struct {
+		name   string
+		msg    *D.Msg
+		cached bool
+	}{
+		{"answer", testMsg(t, "www.example.org.", D.TypeA, "www.example.org. 300 IN A 192.0.2.1"), true},
+		{"truncated", truncated, false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		cache, err := LEC.New(16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		putMsgToCache(cache, "key", tt.msg)
+		if _, _, ok := cache.Get("key"); ok != tt.cached {
+			t.Errorf("%s: cached %t, want %t", tt.name, ok, tt.cached)
+		}
+	}
+}
+
+func TestStaleAnswer(t *testing.T) {
+	updated := make(chan struct{})
+	strategy := func(m *D.Msg, _ *Resolver) (*D.Msg, error) {
+		defer close(updated)
+		return testMsg(t, "www.example.org.", D.TypeA, "www.example.org. 300 IN A 192.0.2.2"), nil
+	}
+	cache, err := LEC.New(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Resolver{StrategyFun: strategy, lruExpiresCache: cache}
+	m := new(D.Msg)
+	m.SetQuestion("www.example.org.", D.TypeA)
+	stale := testMsg(t, "www.example.org.", D.TypeA, "www.example.org. 300 IN A 192.0.2.1")
+	cache.Add(m.Question[0].String(), stale, time.Now().Add(-time.Minute))
+
+	// the stale answer is served at once, and updated in the background
+	msg, err := r.Exchange(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := msg.Answer[0].(*D.A); a.A.String() != "192.0.2.1" || a.Hdr.Ttl != 1 {
+		t.Errorf("answer %v, want the stale one with TTL 1", a)
+	}
+	if edes := GetEDE(msg); len(edes) != 1 || edes[0].InfoCode != D.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("EDE %v, want a stale answer", edes)
+	}
+	if GetEDE(stale) != nil {
+		t.Error("EDE added to the cached answer")
+	}
+	<-updated
+}
@@ -0,0 +1,269 @@
+package resolver
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	D "github.com/miekg/dns"
+)
+
+// maxCNAMEChain limits how many CNAMEs are followed inside a zone.
+const maxCNAMEChain = 8
+
+type ZoneConfig struct {
+	File   string
+	Origin string
+}
+
+// Zone is a local zone loaded from a RFC 1035 zone file,
+// which is answered authoritatively.
+type Zone struct {
+	Origin  string
+	soa     *D.SOA
+	records map[string][]D.RR
+	// names holds every owner name and empty non-terminal in the zone
+	names map[string]bool
+}
+
+type Zones []*Zone
+
+func parentName(name string) string {
+	i, end := D.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+func filterType(rrs []D.RR, t uint16) (ret []D.RR) {
+	for _, rr := range rrs {
+		if t == D.TypeANY || rr.Header().Rrtype == t {
+			ret = append(ret, rr)
+		}
+	}
+	return
+}
+
+func copyRRs(rrs []D.RR) []D.RR {
+	ret := make([]D.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		ret = append(ret, D.Copy(rr))
+	}
+	return ret
+}
+
+func LoadZone(config *ZoneConfig) (*Zone, error) {
+	f, err := os.Open(config.File)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	var origin string
+	if config.Origin != "" {
+		origin = D.Fqdn(config.Origin)
+	}
+
+	z := &Zone{
+		records: make(map[string][]D.RR),
+		names:   make(map[string]bool),
+	}
+
+	zp := D.NewZoneParser(f, origin, config.File)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, ok := rr.(*D.SOA); ok {
+			if z.soa != nil {
+				return nil, fmt.Errorf("zone file %s has more than one SOA record", config.File)
+			}
+			z.soa = soa
+		}
+		name := D.CanonicalName(rr.Header().Name)
+		z.records[name] = append(z.records[name], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	if z.soa == nil {
+		return nil, fmt.Errorf("zone file %s has no SOA record", config.File)
+	}
+	z.Origin = D.CanonicalName(z.soa.Hdr.Name)
+	if origin != "" && D.CanonicalName(origin) != z.Origin {
+		return nil, fmt.Errorf("zone file %s: SOA %s doesn't match origin %s", config.File, z.Origin, origin)
+	}
+
+	z.names[z.Origin] = true
+	for name := range z.records {
+		if !D.IsSubDomain(z.Origin, name) {
+			return nil, fmt.Errorf("zone file %s: %s is out of zone %s", config.File, name, z.Origin)
+		}
+		for n := name; n != z.Origin; n = parentName(n) {
+			z.names[n] = true
+		}
+	}
+
+	return z, nil
+}
+
+func LoadZones(configs ...*ZoneConfig) (zones Zones, err error) {
+	for _, config := range configs {
+		z, err := LoadZone(config)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, z)
+	}
+	return
+}
+
+func listenZoneFiles(r *Resolver, configs []*ZoneConfig) {
+	var paths []string
+	for _, config := range configs {
+		paths = append(paths, config.File)
+	}
+
+	watchFiles(paths, func() {
+		zones, err := LoadZones(configs...)
+		if err != nil {
+			// keep serving the old zones, otherwise their names would be
+			// sent to the upstreams until the file is fixed
+			log.Println("Load zone file error:", err.Error())
+			return
+		}
+		r.Zones = zones
+	})
+}
+
+// match returns the zone with the longest origin which name belongs to.
+func (zs Zones) match(name string) (zone *Zone) {
+	name = D.CanonicalName(name)
+	for _, z := range zs {
+		if !D.IsSubDomain(z.Origin, name) {
+			continue
+		}
+		if zone == nil || D.CountLabel(z.Origin) > D.CountLabel(zone.Origin) {
+			zone = z
+		}
+	}
+	return
+}
+
+// negativeSOA returns the SOA for negative answers, whose TTL is
+// the minimum of the SOA TTL and the SOA MINIMUM field (RFC 2308).
+func (z *Zone) negativeSOA() []D.RR {
+	soa := D.Copy(z.soa).(*D.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return []D.RR{soa}
+}
+
+// delegation returns the NS records of the topmost zone cut above
+// or at name, if there is one.
+func (z *Zone) delegation(name string) (cut []D.RR) {
+	for n := name; n != z.Origin; n = parentName(n) {
+		if ns := filterType(z.records[n], D.TypeNS); len(ns) > 0 {
+			cut = ns
+		}
+	}
+	return
+}
+
+// glue returns the in-zone addresses of the name servers in ns.
+func (z *Zone) glue(ns []D.RR) (extra []D.RR) {
+	for _, rr := range ns {
+		target := D.CanonicalName(rr.(*D.NS).Ns)
+		extra = append(extra, filterType(z.records[target], D.TypeA)...)
+		extra = append(extra, filterType(z.records[target], D.TypeAAAA)...)
+	}
+	return
+}
+
+// lookup returns the records owned by name, synthesizing them from a
+// wildcard if needed. ok is false if the name doesn't exist.
+func (z *Zone) lookup(name string) (rrs []D.RR, ok bool) {
+	if rrs, ok := z.records[name]; ok {
+		return rrs, true
+	}
+	if z.names[name] {
+		// empty non-terminal
+		return nil, true
+	}
+
+	for n := name; n != z.Origin; {
+		n = parentName(n)
+		if !z.names[n] {
+			continue
+		}
+
+		// n is the closest encloser (RFC 4592)
+		wildcard, ok := z.records["*."+n]
+		if !ok {
+			return nil, false
+		}
+		for _, rr := range wildcard {
+			rr = D.Copy(rr)
+			rr.Header().Name = name
+			rrs = append(rrs, rr)
+		}
+		return rrs, true
+	}
+
+	return nil, false
+}
+
+// Exchange answers m authoritatively from the zone.
+func (z *Zone) Exchange(m *D.Msg) *D.Msg {
+	q := m.Question[0]
+
+	msg := new(D.Msg)
+	msg.SetReply(m)
+	msg.Authoritative = true
+
+	name := D.CanonicalName(q.Name)
+	for i := 0; i <= maxCNAMEChain; i++ {
+		if ns := z.delegation(name); ns != nil {
+			// referral to the child zone
+			if len(msg.Answer) == 0 {
+				msg.Authoritative = false
+			}
+			msg.Ns = copyRRs(ns)
+			msg.Extra = copyRRs(z.glue(ns))
+			return msg
+		}
+
+		rrs, ok := z.lookup(name)
+		if !ok {
+			msg.Rcode = D.RcodeNameError
+			msg.Ns = z.negativeSOA()
+			return msg
+		}
+
+		if answer := filterType(rrs, q.Qtype); len(answer) > 0 {
+			msg.Answer = append(msg.Answer, copyRRs(answer)...)
+			return msg
+		}
+
+		cname := filterType(rrs, D.TypeCNAME)
+		if len(cname) == 0 {
+			// NODATA
+			msg.Ns = z.negativeSOA()
+			return msg
+		}
+
+		msg.Answer = append(msg.Answer, D.Copy(cname[0]))
+		name = D.CanonicalName(cname[0].(*D.CNAME).Target)
+		if !D.IsSubDomain(z.Origin, name) {
+			return msg
+		}
+	}
+
+	log.Printf("CNAME chain of %s in zone %s is too long\n", q.Name, z.Origin)
+	msg.Rcode = D.RcodeServerFailure
+	return msg
+}
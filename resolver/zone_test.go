@@ -0,0 +1,161 @@
+package resolver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	D "github.com/miekg/dns"
+)
+
+const testZoneFile = `$ORIGIN example.org.
+$TTL 300
+@        IN SOA ns.example.org. admin.example.org. 1 3600 600 86400 60
+@        IN NS  ns.example.org.
+ns       IN A   192.0.2.1
+www      IN A   192.0.2.2
+a.b      IN A   192.0.2.3
+*.wild   IN A   192.0.2.4
+alias    IN CNAME www
+external IN CNAME www.example.net.
+sub      IN NS  ns.sub
+ns.sub   IN A   192.0.2.5
+`
+
+func loadTestZone(t *testing.T) *Zone {
+	t.Helper()
+	var chain strings.Builder
+	// loop0 to loop9 are a CNAME chain longer than followed
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&chain, "loop%d IN CNAME loop%d\n", i, i+1)
+	}
+	file := filepath.Join(t.TempDir(), "example.org.zone")
+	if err := os.WriteFile(file, []byte(testZoneFile+chain.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	z, err := LoadZone(&ZoneConfig{File: file, Origin: "example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestZoneExchange(t *testing.T) {
+	z := loadTestZone(t)
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		rcode int
+		aa    bool
+		// answer, ns and extra are the types and owners of the records
+		answer, ns, extra []string
+	}{
+		{
+			name: "answer", qname: "WWW.example.org.", qtype: D.TypeA, aa: true,
+			answer: []string{"A www.example.org."},
+		},
+		{
+			name: "nxdomain", qname: "none.example.org.", qtype: D.TypeA,
+			rcode: D.RcodeNameError, aa: true,
+			ns: []string{"SOA example.org."},
+		},
+		{
+			name: "nodata", qname: "www.example.org.", qtype: D.TypeAAAA, aa: true,
+			ns: []string{"SOA example.org."},
+		},
+		{
+			name: "empty non-terminal", qname: "b.example.org.", qtype: D.TypeA, aa: true,
+			ns: []string{"SOA example.org."},
+		},
+		{
+			name: "wildcard", qname: "x.y.wild.example.org.", qtype: D.TypeA, aa: true,
+			answer: []string{"A x.y.wild.example.org."},
+		},
+		{
+			name: "wildcard nodata", qname: "x.wild.example.org.", qtype: D.TypeTXT, aa: true,
+			ns: []string{"SOA example.org."},
+		},
+		{
+			name: "cname", qname: "alias.example.org.", qtype: D.TypeA, aa: true,
+			answer: []string{"CNAME alias.example.org.", "A www.example.org."},
+		},
+		{
+			name: "cname out of zone", qname: "external.example.org.", qtype: D.TypeA, aa: true,
+			answer: []string{"CNAME external.example.org."},
+		},
+		{
+			name: "cname chain limit", qname: "loop0.example.org.", qtype: D.TypeA,
+			rcode: D.RcodeServerFailure, aa: true,
+			answer: []string{
+				"CNAME loop0.example.org.", "CNAME loop1.example.org.", "CNAME loop2.example.org.",
+				"CNAME loop3.example.org.", "CNAME loop4.example.org.", "CNAME loop5.example.org.",
+				"CNAME loop6.example.org.", "CNAME loop7.example.org.", "CNAME loop8.example.org.",
+			},
+		},
+		{
+			name: "referral with glue", qname: "www.sub.example.org.", qtype: D.TypeA,
+			ns:    []string{"NS sub.example.org."},
+			extra: []string{"A ns.sub.example.org."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(D.Msg)
+			m.SetQuestion(tt.qname, tt.qtype)
+			msg := z.Exchange(m)
+
+			if msg.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", D.RcodeToString[msg.Rcode], D.RcodeToString[tt.rcode])
+			}
+			if msg.Authoritative != tt.aa {
+				t.Errorf("AA %t, want %t", msg.Authoritative, tt.aa)
+			}
+			for _, s := range []struct {
+				section string
+				rrs     []D.RR
+				want    []string
+			}{
+				{"answer", msg.Answer, tt.answer},
+				{"authority", msg.Ns, tt.ns},
+				{"additional", msg.Extra, tt.extra},
+			} {
+				var got []string
+				for _, rr := range s.rrs {
+					got = append(got, D.TypeToString[rr.Header().Rrtype]+" "+strings.ToLower(rr.Header().Name))
+				}
+				if strings.Join(got, ", ") != strings.Join(s.want, ", ") {
+					t.Errorf("%s %q, want %q", s.section, got, s.want)
+				}
+			}
+		})
+	}
+
+	// the negative answers are cached for the SOA minimum (RFC 2308)
+	m := new(D.Msg)
+	m.SetQuestion("none.example.org.", D.TypeA)
+	if ttl := z.Exchange(m).Ns[0].Header().Ttl; ttl != 60 {
+		t.Errorf("negative TTL %d, want 60", ttl)
+	}
+}
+
+func TestLoadZoneErrors(t *testing.T) {
+	tests := map[string]string{
+		"no soa":       "www.example.org. 300 IN A 192.0.2.1\n",
+		"two soa":      testZoneFile + "@ IN SOA ns.example.org. admin.example.org. 2 3600 600 86400 60\n",
+		"out of zone":  testZoneFile + "www.example.net. IN A 192.0.2.1\n",
+		"wrong origin": strings.Replace(testZoneFile, "$ORIGIN example.org.", "$ORIGIN example.com.", 1),
+	}
+	for name, content := range tests {
+		file := filepath.Join(t.TempDir(), "zone")
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadZone(&ZoneConfig{File: file, Origin: "example.org."}); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}